@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy check [-container <id>] -pid <pid> [-layout <file>]
+//
+// Check the struct offsets in use against a running process before
+// profiling it. Exits with status 1 if any field looks wrong.
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "PID of Zeek process")
+	reader := fs.String("reader", zeekspy.ReaderSeize, "Memory `reader`: ptrace, seize or vmreadv")
+	attempts := fs.Int("attempts", 1000, "Give up waiting for a non-empty call_stack after `n` samples")
+	layout := layoutFlag(fs)
+	container := containerFlag(fs)
+	fs.Parse(args)
+	if *pid == 0 && *container == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	loadLayoutFile(*layout)
+	zp, err := zeekspy.ZeekProcessFromPid(resolvePid(*pid, *container), zeekspy.Options{Reader: *reader})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zp.Close()
+	log.Printf("Checking %s using %s struct offsets (%s) and %s", zp, zp.OffsetsSource, zp.OffsetsReason, zp.StdLib())
+
+	report, err := zp.Check(*attempts)
+	if err != nil {
+		log.Fatalf("Check failed: %v", err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if !report.Passed() {
+		log.Printf("Struct offsets look wrong, see FAIL lines above")
+		zp.Close()
+		os.Exit(1)
+	}
+	log.Printf("Struct offsets look fine after %d samples", report.Samples)
+}
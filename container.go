@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// Add the -container flag to fs.
+func containerFlag(fs *flag.FlagSet) *string {
+	return fs.String("container", "",
+		"`ID` (or prefix) of the container running Zeek, -pid is then the PID inside the container")
+}
+
+// The host PID to use for -pid and -container.
+func resolvePid(pid int, container string) int {
+	if container == "" {
+		return pid
+	}
+	hostPid, err := zeekspy.FindContainerPid(container, pid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Found pid=%d in container %s", hostPid, container)
+	return hostPid
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy core [-exe zeek] <core>
+//
+// Print the script-land call stack stored in a core file.
+func coreCommand(args []string) {
+	fs := flag.NewFlagSet("core", flag.ExitOnError)
+	exe := fs.String("exe", "", "Zeek `binary` the core was created from (default: path recorded in the core)")
+	layout := layoutFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s core [-exe zeek] [-layout file] <core>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	loadLayoutFile(*layout)
+	zp, err := zeekspy.ZeekProcessFromCore(fs.Arg(0), *exe)
+	if err != nil {
+		log.Fatalf("Could not open core: %v", err)
+	}
+	defer zp.Close()
+
+	log.Printf("Inspecting %s\n", zp)
+	if version, err := zp.Version(); err == nil {
+		log.Printf("Found Zeek version '%s', using %s struct offsets (%s) and %s", version, zp.OffsetsSource, zp.OffsetsReason, zp.StdLib())
+	}
+
+	result, err := zp.Spy()
+	if err != nil {
+		log.Fatalf("Could not read call stack: %v", err)
+	}
+	printStack(result.Stack)
+}
+
+// Print a stack innermost call first, like gdb's backtrace.
+func printStack(stack []zeekspy.Call) {
+	for i := len(stack) - 1; i >= 0; i-- {
+		c := stack[i]
+		fmt.Printf("#%-3d %s at %s:%d\n", len(stack)-1-i, c.Func.Name, c.Filename, c.Line)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy layout dump
+// zeek-spy layout extract -version <version> <file>...
+//
+// Print the built-in struct offsets in layout file format, as a starting
+// point for a -layout file, or the offsets found in the debug info of
+// Zeek builds, e.g. of official packages and their debug packages.
+func layoutCommand(args []string) {
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	version := fs.String("version", "", "Zeek `version` of the files to extract")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s layout dump\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s layout extract -version <version> <file>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(args[1:])
+
+	var lf *zeekspy.LayoutFile
+	switch {
+	case args[0] == "dump" && fs.NArg() == 0:
+		lf = zeekspy.BuiltinLayouts()
+	case args[0] == "extract" && fs.NArg() > 0 && *version != "":
+		lf = &zeekspy.LayoutFile{}
+		for _, path := range fs.Args() {
+			l, err := zeekspy.LayoutFromDebugInfo(path, *version)
+			if err != nil {
+				log.Fatal(err)
+			}
+			lf.Layouts = append(lf.Layouts, *l)
+		}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := lf.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Add the -layout flag to fs.
+func layoutFlag(fs *flag.FlagSet) *string {
+	return fs.String("layout", "", "Load additional struct offsets from layout `file` (see: zeek-spy layout dump)")
+}
+
+func loadLayoutFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := zeekspy.LoadLayoutFile(path); err != nil {
+		log.Fatal(err)
+	}
+}
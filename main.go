@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/awelzel/zeek-spy/zeekspy"
@@ -19,110 +22,155 @@ func init() {
 }
 
 var (
-	pid           int
+	reader        string
+	pageCache     bool
 	hz            uint
 	zeekprofile   string
 	debug         bool
 	statsInterval time.Duration
 )
 
+// Subcommands, without one a running process is sampled.
+var commands = map[string]func(args []string){
+	"core":     coreCommand,
+	"snapshot": snapshotCommand,
+	"replay":   replayCommand,
+	"layout":   layoutCommand,
+	"record":   recordCommand,
+	"check":    checkCommand,
+	"probe":    probeCommand,
+}
+
 func main() {
-	fiveSeconds, _ := time.ParseDuration("5s")
-	flag.IntVar(&pid, "pid", 0, "PID of Zeek process")
-	flag.UintVar(&hz, "hz", 100, "Sampling frequency")
-	flag.BoolVar(&debug, "debug", false, "Enable sample debugging")
-	flag.StringVar(&zeekprofile, "profile", "", "Store pprof `profile` here")
-	flag.DurationVar(&statsInterval, "stats", fiveSeconds,
-		"Print stats every `interval` times.")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	sel := selectionFlags(flag.CommandLine)
+	watch := flag.Bool("watch", false,
+		"Keep sampling new processes selected by -name or -node, or descending from -pid, until Ctrl+C")
+	waitFor := flag.String("wait-for", "", "Wait for a process with a name matching this `regexp` to be ready, then sample it")
+	pollInterval := flag.Duration("poll-interval", 250*time.Millisecond,
+		"Look for new processes every `interval` with -watch and -wait-for")
+	duration := flag.Duration("duration", 0, "Stop sampling after this `duration`, 0 for no limit")
+	maxSamples := flag.Int64("max-samples", 0, "Stop after taking this many samples of all processes, 0 for no limit")
+	samplingFlags(flag.CommandLine)
+	layout := layoutFlag(flag.CommandLine)
+	container := containerFlag(flag.CommandLine)
 	flag.Parse()
 
-	if pid == 0 || zeekprofile == "" {
+	if *waitFor != "" && sel.name == "" {
+		sel.name = *waitFor
+	} else if *waitFor != "" {
+		log.Fatal("-wait-for and -name are exclusive")
+	}
+	if (sel.empty() && *container == "") || zeekprofile == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	roots := sel.roots(*container)
+	var pids []int
+	if *waitFor == "" {
+		var err error
+		if pids, err = sel.match(roots, *watch); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	loadLayoutFile(*layout)
 
 	profileFile, err := os.Create(zeekprofile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer profileFile.Close()
-
-	// Redirect Ctrl+C to signalChannel
-	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt)
 
 	period := time.Duration((1000000 / hz)) * time.Microsecond
+	s := newSession(period)
+	s.maxSamples = *maxSamples
 
-	log.Printf("Using pid=%d, hz=%v period=%v (%.6f ms) profile=%v\n",
-		pid, hz, period, period.Seconds()*1000, zeekprofile)
-	zp := zeekspy.ZeekProcessFromPid(pid)
-	log.Printf("Profiling %s\n", zp)
-	if version, err := zp.Version(); err == nil {
-		log.Printf("Found Zeek version '%s'", version)
-	} else {
-		log.Fatalf("Error reading version: %v", err)
-	}
-
-	profileBuilder := zeekspy.NewProfileBuilder(period)
-
-	stopped := false
-	statsSamplingTime := time.Duration(0)
-	totalSamples := 0
-	nonEmptySamples := 0
-	totalSkipped := 0
-	totalStart := time.Now()
-	nextSample := totalStart
-	nextStats := totalStart.Add(statsInterval)
-	diff := time.Duration(0)
-
-	for !stopped {
-		start := time.Now()
-		if result, err := zp.Spy(); err != nil {
-			log.Printf("[WARN] Failed to spy, exiting (%v)\n", err)
-			stopped = true
-			break
-		} else {
-			diff = time.Since(start)
-			totalSamples += 1
-			profileBuilder.AddSample(result.Stack)
-			if !result.Empty {
-				nonEmptySamples = nonEmptySamples + 1
-				if debug {
-					for i, s := range result.Stack {
-						log.Printf("Sample[%d][%d] %+v\n",
-							totalSamples, i, s)
-					}
-				}
+	// Stop all samplers on Ctrl+C, or SIGTERM and SIGHUP as sent by
+	// systemd or timeout(1). Give up on the profile for a second one.
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-signalChannel
+		s.shutdown(fmt.Sprintf("signal %v", sig))
+		sig = <-signalChannel
+		log.Fatalf("Exiting after second signal %v, profile not written", sig)
+	}()
+
+	log.Printf("Using pids=%v, hz=%v period=%v (%.6f ms) profile=%v reader=%v watch=%v\n",
+		pids, hz, period, period.Seconds()*1000, zeekprofile, reader, *watch)
+	started := true
+	if *waitFor != "" {
+		what := fmt.Sprintf("a process matching %q", *waitFor)
+		if sel.node != "" {
+			what += " of cluster node " + sel.node
+		}
+		log.Printf("Waiting for %s\n", what)
+		if started, err = s.waitFor(sel, roots, *pollInterval); err != nil {
+			log.Fatal(err)
+		}
+	} else if !*watch {
+		for _, pid := range pids {
+			if err := s.start(pid); err != nil {
+				log.Fatal(err)
 			}
-
 		}
-
-		statsSamplingTime += diff
-		skippedSamples := int(diff / period)
-		totalSkipped += skippedSamples
-		nextSample = nextSample.Add(time.Duration(1+skippedSamples) * period)
-
-		select {
-		case <-time.After(time.Until(nextSample)):
-			//
-		case sig := <-signalChannel:
-			log.Printf("Exiting after signal: %v\n", sig)
-			stopped = true
+	}
+	if started {
+		if *duration > 0 {
+			time.AfterFunc(*duration, func() { s.shutdown(fmt.Sprintf("%v elapsed", *duration)) })
 		}
-
-		if now := time.Now(); now.After(nextStats) {
-			elapsed := now.Sub(totalStart)
-			fraction := statsSamplingTime.Seconds() / statsInterval.Seconds()
-			samplingRate := float64(totalSamples) / time.Since(totalStart).Seconds()
-
-			log.Printf("[STATS] elapsed=%.2fs samples=%d (%d total) skipped=%d frequency=%.1fhz overhead=%.2f%% (%v)\n",
-				elapsed.Seconds(), nonEmptySamples, totalSamples, totalSkipped,
-				samplingRate, fraction*100, statsSamplingTime)
-			nextStats = nextStats.Add(statsInterval)
-			statsSamplingTime = time.Duration(0)
+		if *watch {
+			s.watch(sel, roots, *pollInterval)
 		}
 	}
+	s.wg.Wait()
+
+	writeProfile(s.builder, profileFile)
+}
+
+// Write the profile and close f. Exits with status 1 on failure, the
+// profile is incomplete then.
+func writeProfile(builder *zeekspy.ProfileBuilder, f *os.File) {
 	log.Printf("Writing protobuf...\n")
-	profileBuilder.WriteProfile(profileFile)
+	if err := builder.WriteProfile(f); err != nil {
+		log.Fatalf("Could not write profile %s: %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Could not write profile %s: %v", f.Name(), err)
+	}
 	log.Printf("Done.\n")
 }
+
+// Add the flags for sampling to fs.
+func samplingFlags(fs *flag.FlagSet) {
+	fiveSeconds, _ := time.ParseDuration("5s")
+	fs.UintVar(&hz, "hz", 100, "Sampling frequency")
+	fs.StringVar(&reader, "reader", zeekspy.ReaderPtrace,
+		"Memory `reader`: ptrace (attach for every sample), seize (attach once) or vmreadv (never stops Zeek)")
+	fs.BoolVar(&pageCache, "page-cache", true, "Read whole pages and serve all reads of a sample from them")
+	fs.BoolVar(&debug, "debug", false, "Enable sample debugging")
+	fs.StringVar(&zeekprofile, "profile", "", "Store pprof `profile` here")
+	fs.DurationVar(&statsInterval, "stats", fiveSeconds,
+		"Print stats every `interval` times.")
+}
+
+// Labels of the samples of pid. node and role are only set for cluster
+// processes.
+func sampleLabels(pid int) zeekspy.Labels {
+	host, _ := os.Hostname()
+	labels := zeekspy.Labels{"pid": strconv.Itoa(pid), "host": host}
+	node := zeekspy.ProcessClusterNode(pid)
+	if node.Name != "" {
+		labels["node"] = node.Name
+	}
+	if node.Role != "" {
+		labels["role"] = node.Role
+	}
+	return labels
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// PIDs given with -pid, comma separated or by repeating it.
+type pidList []int
+
+func (l *pidList) String() string {
+	var s []string
+	for _, pid := range *l {
+		s = append(s, strconv.Itoa(pid))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *pidList) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, pid)
+	}
+	return nil
+}
+
+// How processes to sample are selected.
+type selection struct {
+	pids pidList
+	name string
+	node string
+}
+
+// Add -pid, -name and -node to fs.
+func selectionFlags(fs *flag.FlagSet) *selection {
+	sel := &selection{}
+	fs.Var(&sel.pids, "pid", "PIDs of Zeek processes, comma separated")
+	fs.StringVar(&sel.name, "name", "", "Profile all processes with a name matching this `regexp`, as pgrep(1)")
+	fs.StringVar(&sel.node, "node", "", "Profile the processes of this cluster `node`, e.g. worker-1-3")
+	return sel
+}
+
+func (sel *selection) empty() bool {
+	return len(sel.pids) == 0 && sel.name == "" && sel.node == ""
+}
+
+// The host PIDs given with -pid and -container.
+func (sel *selection) roots(container string) []int {
+	if container != "" && len(sel.pids) == 0 && sel.name == "" {
+		return []int{resolvePid(0, container)}
+	}
+	var roots []int
+	for _, pid := range sel.pids {
+		roots = append(roots, resolvePid(pid, container))
+	}
+	return roots
+}
+
+// The PIDs to sample: roots, their descendants if requested, and those
+// matching -name, restricted to -node if given. Sorted and without
+// duplicates. -node alone considers all processes with Zeek's symbols,
+// not e.g. the shell zeekctl runs Zeek from, which has CLUSTER_NODE set
+// as well.
+func (sel *selection) match(roots []int, descendants bool) ([]int, error) {
+	selected := append([]int{}, roots...)
+	if descendants {
+		found, err := zeekspy.FindDescendants(roots)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, found...)
+	}
+	name := sel.name
+	anyZeek := sel.node != "" && len(roots) == 0 && name == ""
+	if anyZeek {
+		name = "."
+	}
+	if name != "" {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad -name: %v", err)
+		}
+		found, err := zeekspy.FindPidsByName(re)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, found...)
+	}
+
+	sort.Ints(selected)
+	var unique []int
+	for i, pid := range selected {
+		if i > 0 && pid == selected[i-1] {
+			continue
+		}
+		if sel.node != "" && zeekspy.ProcessClusterNode(pid).Name != sel.node {
+			continue
+		}
+		if anyZeek && !zeekspy.HasZeekSymbols(pid) {
+			continue
+		}
+		unique = append(unique, pid)
+	}
+	if len(unique) == 0 && sel.node != "" {
+		return nil, fmt.Errorf("No process of cluster node %s", sel.node)
+	} else if len(unique) == 0 {
+		return nil, fmt.Errorf("No process matching %q", sel.name)
+	}
+	return unique, nil
+}
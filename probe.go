@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy probe [-container <id>] -pid <pid> [-o <file>]
+//
+// Guess struct offsets from live objects of a Zeek build without debug
+// info and print them in layout file format for review.
+func probeCommand(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "PID of Zeek process")
+	reader := fs.String("reader", zeekspy.ReaderSeize, "Memory `reader`: ptrace, seize or vmreadv")
+	samples := fs.Int("samples", 200, "Collect objects from `n` samples")
+	output := fs.String("o", "", "Write layout file to `file` instead of stdout")
+	container := containerFlag(fs)
+	fs.Parse(args)
+	if *pid == 0 && *container == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	zp, err := zeekspy.ZeekProcessFromPid(resolvePid(*pid, *container),
+		zeekspy.Options{Reader: *reader, AnyVersion: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zp.Close()
+	version, err := zp.Version()
+	if err != nil {
+		log.Fatalf("Error reading version: %v", err)
+	}
+	log.Printf("Probing %s, Zeek version '%s' with %s", zp, version, zp.StdLib())
+
+	result, err := zp.ProbeOffsets(*samples)
+	if err != nil {
+		log.Fatalf("Probing failed: %v", err)
+	}
+	log.Printf("Used %d of %d samples", result.NonEmpty, result.Samples)
+	for _, note := range result.Notes {
+		log.Printf("  %s", note)
+	}
+
+	lf := &zeekspy.LayoutFile{Layouts: []zeekspy.Layout{{
+		Version: version,
+		BuildID: zp.BuildID,
+		Offsets: result.Offsets,
+	}}}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	if err := lf.Write(out); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Review, then verify with: zeek-spy check -layout <file> -pid %d", zp.Pid)
+}
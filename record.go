@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy record -profile <file> -- zeek -r file.pcap local
+//
+// Start Zeek and profile it from startup until it exits. Exits with the
+// exit code of Zeek.
+func recordCommand(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s record [options] -- zeek [zeek options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	samplingFlags(fs)
+	layout := layoutFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 || zeekprofile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	loadLayoutFile(*layout)
+
+	profileFile, err := os.Create(zeekprofile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Zeek runs in its own process group, forward signals to it.
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	period := time.Duration((1000000 / hz)) * time.Microsecond
+	log.Printf("Starting %v, hz=%v period=%v profile=%v reader=%v\n",
+		fs.Args(), hz, period, zeekprofile, reader)
+	pid, err := zeekspy.StartZeek(fs.Args())
+	if err != nil {
+		if exit, ok := err.(*zeekspy.ChildExitError); ok {
+			log.Printf("[WARN] %v", err)
+			os.Exit(zeekspy.ExitCode(exit.Status))
+		}
+		log.Fatalf("Could not start Zeek: %v", err)
+	}
+
+	s := newSession(period)
+	sampler, err := s.attach(pid)
+	if err != nil {
+		// Do not leave Zeek running without the profiler.
+		log.Printf("[WARN] Could not profile Zeek, killing it: %v", err)
+		if err := zeekspy.KillChild(pid); err != nil {
+			log.Printf("[WARN] Could not kill Zeek: %v", err)
+		}
+		os.Exit(1)
+	}
+	if err := zeekspy.ResumeChild(pid); err != nil {
+		log.Fatalf("Could not resume Zeek: %v", err)
+	}
+
+	go func() {
+		for sig := range signalChannel {
+			log.Printf("Forwarding signal %v to Zeek\n", sig)
+			if err := syscall.Kill(pid, sig.(syscall.Signal)); err != nil {
+				log.Printf("[WARN] Could not forward signal: %v", err)
+			}
+		}
+	}()
+
+	// Sampling ends when Zeek exits.
+	s.run(sampler)
+	sampler.Close()
+
+	status, ok := sampler.Process().ExitStatus()
+	if !ok {
+		if status, err = zeekspy.WaitChild(pid); err != nil {
+			log.Fatalf("Could not wait for Zeek: %v", err)
+		}
+	}
+	log.Printf("Zeek exited with status %d", zeekspy.ExitCode(status))
+
+	writeProfile(s.builder, profileFile)
+	os.Exit(zeekspy.ExitCode(status))
+}
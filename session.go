@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// How often a process that could not be attached to is tried again in
+// watch mode, e.g. while it has not loaded libzeek.so yet.
+const watchAttempts = 5
+
+// Processes sampled into a single profile, each by its own Sampler.
+type session struct {
+	period  time.Duration
+	builder *zeekspy.ProfileBuilder
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	stopOnce   sync.Once
+	maxSamples int64 // 0 for no limit
+	samples    int64 // accessed atomically
+
+	// Processes sampled, only used by the goroutine starting them.
+	sampled map[zeekspy.ProcessKey]bool
+}
+
+func newSession(period time.Duration) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		period:  period,
+		builder: zeekspy.NewProfileBuilder(period),
+		ctx:     ctx,
+		cancel:  cancel,
+		sampled: make(map[zeekspy.ProcessKey]bool),
+	}
+}
+
+// Stop all samplers, may be called more than once.
+func (s *session) shutdown(reason string) {
+	s.stopOnce.Do(func() {
+		log.Printf("Stopping after %s\n", reason)
+		s.cancel()
+	})
+}
+
+// Add a sample to the profile, stops the session once maxSamples were
+// added.
+func (s *session) add(sample *zeekspy.Sample) {
+	n := atomic.AddInt64(&s.samples, 1)
+	if s.maxSamples > 0 && n > s.maxSamples {
+		return
+	}
+	s.builder.AddLabeledSample(sample.Stack, sample.Labels)
+	if n == s.maxSamples {
+		s.shutdown(fmt.Sprintf("%d samples", s.maxSamples))
+	}
+	if debug && !sample.Empty && !sample.Inconsistent {
+		for i, c := range sample.Stack {
+			log.Printf("Sample[pid=%d][%d] %+v\n", sample.Pid, i, c)
+		}
+	}
+}
+
+func logStats(st *zeekspy.SamplerStats) {
+	log.Printf("[STATS] pid=%d elapsed=%.2fs samples=%d (%d total) skipped=%d inconsistent=%d (%d retries) failed=%d frequency=%.1fhz overhead=%.2f%% (%v) syscalls=%.1f/sample\n",
+		st.Pid, st.Elapsed.Seconds(), st.NonEmpty, st.Samples, st.Skipped,
+		st.Inconsistent, st.Retries, st.Failed,
+		st.Frequency(), st.Overhead()*100, st.SamplingTime, st.SyscallsPerSample())
+}
+
+// Attach a Sampler to pid, sampling into the profile.
+func (s *session) attach(pid int) (*zeekspy.Sampler, error) {
+	sampler, err := zeekspy.NewSampler(zeekspy.SamplerConfig{
+		Pid:           pid,
+		Options:       zeekspy.Options{Reader: reader, PageCache: pageCache},
+		Period:        s.period,
+		Labels:        sampleLabels(pid),
+		OnSample:      s.add,
+		StatsInterval: statsInterval,
+		OnStats:       logStats,
+	})
+	if err != nil {
+		return nil, err
+	}
+	zp := sampler.Process()
+	log.Printf("Profiling %s (%s)\n", zp, sampleLabels(pid))
+	log.Printf("Found Zeek version '%s' in pid=%d, using %s struct offsets (%s) and %s", sampler.Version(), pid, zp.OffsetsSource, zp.OffsetsReason, zp.StdLib())
+	return sampler, nil
+}
+
+// Sample until the process exits or the session is stopped.
+func (s *session) run(sampler *zeekspy.Sampler) {
+	err := sampler.Run(s.ctx)
+	var exited *zeekspy.ProcessExitedError
+	if errors.As(err, &exited) {
+		log.Printf("Process %d exited\n", exited.Pid)
+	} else if err != nil {
+		log.Printf("[WARN] Failed to spy pid=%d, stopping (%v)\n", sampler.Process().Pid, err)
+	}
+}
+
+// Attach to pid and sample it in the background until it exits or the
+// session is stopped. Processes already sampled are skipped.
+func (s *session) start(pid int) error {
+	key, err := zeekspy.ProcessKeyOf(pid)
+	if err != nil {
+		return err
+	}
+	if s.sampled[key] {
+		return nil
+	}
+	sampler, err := s.attach(pid)
+	if err != nil {
+		return err
+	}
+	s.sampled[key] = true
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer sampler.Close()
+		s.run(sampler)
+	}()
+	return nil
+}
+
+// Poll until a process selected by sel and roots can be attached to,
+// i.e. it exists and Zeek's symbols are found and readable, and sample
+// all such processes. Returns false if the session was stopped before,
+// or an error if attaching is not permitted, which waiting won't change.
+func (s *session) waitFor(sel *selection, roots []int, interval time.Duration) (bool, error) {
+	pids := func() []int {
+		pids, _ := sel.match(roots, false)
+		return pids
+	}
+	return waitUntilStarted(s.ctx, pids, s.start, interval)
+}
+
+// Call start for the PIDs returned by pids every interval until it
+// succeeds for at least one of them. Errors are logged once per PID
+// until they change.
+func waitUntilStarted(ctx context.Context, pids func() []int, start func(int) error, interval time.Duration) (bool, error) {
+	lastErrs := make(map[int]string)
+	for {
+		started := 0
+		for _, pid := range pids() {
+			err := start(pid)
+			var perm *zeekspy.PermissionError
+			if err == nil {
+				started++
+			} else if errors.As(err, &perm) {
+				return false, err
+			} else if msg := err.Error(); lastErrs[pid] != msg {
+				log.Printf("Not profiling pid=%d yet: %v\n", pid, err)
+				lastErrs[pid] = msg
+			}
+		}
+		if started > 0 {
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll for the processes selected by sel and roots, including
+// descendants of the latter, and sample new ones until the session is
+// stopped. New processes have their own symbols and layout.
+func (s *session) watch(sel *selection, roots []int, interval time.Duration) {
+	// Failed attempts per process. Processes are told apart by their
+	// start time in case a PID is reused.
+	attempts := make(map[zeekspy.ProcessKey]int)
+	for {
+		pids, _ := sel.match(roots, true)
+		current := make(map[zeekspy.ProcessKey]int)
+		for _, pid := range pids {
+			key, err := zeekspy.ProcessKeyOf(pid)
+			if err != nil {
+				continue
+			}
+			n := attempts[key]
+			if n < watchAttempts {
+				if err := s.start(pid); err != nil {
+					if n++; n == watchAttempts {
+						log.Printf("[WARN] Not profiling pid=%d: %v", pid, err)
+					}
+				}
+			}
+			current[key] = n
+		}
+		attempts = current
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// Capture the log output of f.
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return buf.String()
+}
+
+func TestWaitUntilStarted(t *testing.T) {
+	attempts := 0
+	start := func(pid int) error {
+		if attempts++; attempts < 3 {
+			return errors.New("no symbols")
+		}
+		return nil
+	}
+	var started bool
+	var err error
+	out := captureLog(func() {
+		started, err = waitUntilStarted(context.Background(), func() []int { return []int{42} }, start, time.Millisecond)
+	})
+	if !started || err != nil || attempts != 3 {
+		t.Errorf("Expected start after 3 attempts, got %v, %v after %d", started, err, attempts)
+	}
+	if n := strings.Count(out, "pid=42"); n != 1 {
+		t.Errorf("Expected the error to be logged once, got %d times:\n%s", n, out)
+	}
+}
+
+func TestWaitUntilStartedPermission(t *testing.T) {
+	attempts := 0
+	start := func(pid int) error {
+		attempts++
+		return &zeekspy.PermissionError{Pid: pid, Err: syscall.EPERM}
+	}
+	started, err := waitUntilStarted(context.Background(), func() []int { return []int{42} }, start, time.Millisecond)
+	var perm *zeekspy.PermissionError
+	if started || !errors.As(err, &perm) || attempts != 1 {
+		t.Errorf("Expected PermissionError after one attempt, got %v, %v after %d", started, err, attempts)
+	}
+}
+
+// A process that cannot be attached to because it is traced already
+// fails through the real NewSampler, rather than being polled for ever.
+func TestWaitUntilStartedTraced(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	lib, err := filepath.Abs("zeekspy/testdata/dwarf/libzeek-layout-stripped.so.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.StartProcess("/bin/sleep", []string{"sleep", "10"}, &os.ProcAttr{
+		Env: []string{"LD_PRELOAD=" + lib},
+		Sys: &syscall.SysProcAttr{Ptrace: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		syscall.Kill(proc.Pid, syscall.SIGKILL)
+		proc.Wait()
+	}()
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(proc.Pid, &status, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.PtraceCont(proc.Pid, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(time.Millisecond)
+	defer s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var started bool
+	captureLog(func() {
+		started, err = waitUntilStarted(ctx, func() []int { return []int{proc.Pid} }, s.start, time.Millisecond)
+	})
+	var perm *zeekspy.PermissionError
+	if started || !errors.As(err, &perm) {
+		t.Errorf("Expected PermissionError, got %v, %v", started, err)
+	}
+}
+
+func TestWaitUntilStartedStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started, err := waitUntilStarted(ctx, func() []int { return nil }, func(int) error { return nil }, time.Hour)
+	if started || err != nil {
+		t.Errorf("Expected false without error, got %v, %v", started, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/awelzel/zeek-spy/zeekspy"
+)
+
+// zeek-spy snapshot [-container <id>] -pid <pid> -o <file>
+//
+// Record the memory read for a single sample, e.g. to create test
+// fixtures for a Zeek version.
+func snapshotCommand(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "PID of Zeek process")
+	reader := fs.String("reader", zeekspy.ReaderPtrace, "Memory `reader`: ptrace, seize or vmreadv")
+	output := fs.String("o", "", "Write snapshot to `file`")
+	comment := fs.String("comment", "", "Free form `description` stored in the snapshot")
+	nonEmpty := fs.Bool("non-empty", true, "Retry until the call_stack is not empty")
+	attempts := fs.Int("attempts", 1000, "Give up after `n` samples")
+	layout := layoutFlag(fs)
+	container := containerFlag(fs)
+	fs.Parse(args)
+	if (*pid == 0 && *container == "") || *output == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	loadLayoutFile(*layout)
+	zp, err := zeekspy.ZeekProcessFromPid(resolvePid(*pid, *container), zeekspy.Options{Reader: *reader})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Detach before anything may log.Fatal, deferred calls don't run then.
+	snapshot, err := zp.RecordSnapshot(*nonEmpty, *attempts)
+	zp.Close()
+	if err != nil {
+		log.Fatalf("Could not record snapshot: %v", err)
+	}
+	snapshot.Comment = *comment
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := snapshot.Write(f); err != nil {
+		log.Fatalf("Could not write snapshot: %v", err)
+	}
+	log.Printf("Recorded %d reads of Zeek %s (empty=%v) into %s\n",
+		len(snapshot.Reads), snapshot.Version, snapshot.Empty, *output)
+}
+
+// zeek-spy replay <file>
+//
+// Decode the stack stored in a snapshot and print it.
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay <snapshot>\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	snapshot, err := zeekspy.ReadSnapshot(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	zp, err := zeekspy.ZeekProcessFromSnapshot(snapshot)
+	if err != nil {
+		log.Fatalf("Could not replay snapshot: %v", err)
+	}
+	result, err := zp.Spy()
+	if err != nil {
+		log.Fatalf("Could not read call stack: %v", err)
+	}
+	printStack(result.Stack)
+}
@@ -0,0 +1,340 @@
+// Checking struct offsets against a live process
+//
+// With wrong offsets, sampling produces garbage names or fails with a
+// layout mismatch at some point. Check() instead walks call_stack,
+// g_frame_stack and the objects reachable from them once and reports
+// for every field whether the values read look plausible.
+package zeekspy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Fields checked, in report order.
+var checkFields = []string{
+	"version",
+	"call_stack",
+	"g_frame_stack",
+	"CallInfo::func",
+	"CallInfo::call",
+	"Frame::next_stmt",
+	"Func::kind",
+	"Func::name",
+	"Obj::location",
+	"Location::filename",
+	"Location::first_line",
+	"Location::last_line",
+}
+
+var (
+	versionRegexp  = regexp.MustCompile(`^\d+\.\d+`)
+	funcNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_:]*$`)
+)
+
+// Script filename suffixes, .bro for Zeek 3.
+var scriptSuffixes = []string{".zeek", ".bif", ".bro"}
+
+// Larger line numbers are considered garbage.
+const maxLine = 1 << 20
+
+type CheckResult struct {
+	Field   string
+	Checked int // Number of values checked, 0 if none were found
+	Failed  int
+	Detail  string // First failure, or an example value
+}
+
+func (r *CheckResult) Status() string {
+	switch {
+	case r.Failed > 0:
+		return "FAIL"
+	case r.Checked == 0:
+		return "SKIP"
+	}
+	return "PASS"
+}
+
+type CheckReport struct {
+	Results []*CheckResult
+
+	// Samples taken until call_stack was not empty.
+	Samples int
+}
+
+// Whether no field failed.
+func (r *CheckReport) Passed() bool {
+	for _, result := range r.Results {
+		if result.Failed > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CheckReport) Write(w io.Writer) error {
+	for _, result := range r.Results {
+		counts := ""
+		if result.Checked > 0 {
+			counts = fmt.Sprintf("%d/%d plausible", result.Checked-result.Failed, result.Checked)
+		}
+		_, err := fmt.Fprintf(w, "%s  %-22s %-16s %s\n", result.Status(), result.Field, counts, result.Detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type checker struct {
+	zp      *ZeekProcess
+	results map[string]*CheckResult
+}
+
+// Record a value of field read at addr, and err if it is not plausible.
+func (c *checker) record(field string, addr uintptr, value interface{}, err error) {
+	r := c.results[field]
+	r.Checked++
+	if err != nil {
+		if r.Failed == 0 {
+			r.Detail = fmt.Sprintf("at %#x: %v", addr, err)
+		}
+		r.Failed++
+	} else if r.Failed == 0 && r.Detail == "" {
+		r.Detail = fmt.Sprintf("e.g. %v", value)
+	}
+}
+
+// Skip a field, e.g. because its offset is unknown.
+func (c *checker) skip(field, reason string) {
+	c.results[field].Detail = reason
+}
+
+func (c *checker) readPtr(what string, addr uintptr) (uintptr, error) {
+	data := make([]byte, 8)
+	if err := c.zp.read(what, addr, data); err != nil {
+		return 0, err
+	}
+	return uintptr(binary.LittleEndian.Uint64(data)), nil
+}
+
+// Pointers must point into a readable mapping.
+func (c *checker) ptrErr(ptr uintptr) error {
+	if ptr == 0 {
+		return fmt.Errorf("NULL")
+	}
+	if c.zp.regions != nil && !c.zp.regions.check(ptr, 8) {
+		return fmt.Errorf("%#x not in a readable mapping", ptr)
+	}
+	return nil
+}
+
+// Record whether ptr is valid for field.
+func (c *checker) checkPtr(field string, addr, ptr uintptr) bool {
+	err := c.ptrErr(ptr)
+	c.record(field, addr, fmt.Sprintf("%#x", ptr), err)
+	return err == nil
+}
+
+func isScript(filename string) bool {
+	for _, suffix := range scriptSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func printable(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) checkFunc(addr uintptr) {
+	o := c.zp.offsets
+	data := make([]byte, 4)
+	err := c.zp.read("Func", addr+uintptr(o.FuncKind), data)
+	kind := binary.LittleEndian.Uint32(data)
+	if err == nil && kind != BRO_FUNC && kind != BUILTIN_FUNC {
+		err = fmt.Errorf("kind %d", kind)
+	}
+	c.record("Func::kind", addr, kind, err)
+
+	data = make([]byte, c.zp.stdlib.stringSize())
+	nameAddr := addr + uintptr(o.FuncName)
+	var name string
+	if err = c.zp.read("Func", nameAddr, data); err == nil {
+		name, err = c.zp.stdlib.decodeString(c.zp, nameAddr, data)
+	}
+	if err == nil && !funcNameRegexp.MatchString(name) {
+		err = fmt.Errorf("name %q", name)
+	}
+	c.record("Func::name", addr, fmt.Sprintf("%q", name), err)
+
+	c.checkObjLocation(addr)
+}
+
+// Check the location of a BroObj, which may have none.
+func (c *checker) checkObjLocation(addr uintptr) {
+	locPtr, err := c.readPtr("BroObj", addr+uintptr(c.zp.offsets.ObjLocation))
+	if err != nil {
+		c.record("Obj::location", addr, nil, err)
+		return
+	}
+	if locPtr != 0 && c.checkPtr("Obj::location", addr, locPtr) {
+		c.checkLocation(locPtr)
+	}
+}
+
+func (c *checker) checkLocation(addr uintptr) {
+	o := c.zp.offsets
+	data := make([]byte, o.LocationSize)
+	if err := c.zp.read("Location", addr, data); err != nil {
+		c.record("Location::filename", addr, nil, err)
+		return
+	}
+
+	namePtr := uintptr(binary.LittleEndian.Uint64(data[o.LocationFilename:]))
+	var name string
+	err := c.ptrErr(namePtr)
+	if err == nil {
+		name, err = c.zp.readNullTerminatedStr(namePtr)
+	}
+	if err == nil && !printable(name) {
+		err = fmt.Errorf("filename %q", name)
+	} else if err == nil && !isScript(name) {
+		err = fmt.Errorf("filename %q is not a script", name)
+	}
+	c.record("Location::filename", addr, fmt.Sprintf("%q", name), err)
+
+	first := int32(binary.LittleEndian.Uint32(data[o.LocationFirstLine:]))
+	last := int32(binary.LittleEndian.Uint32(data[o.LocationLastLine:]))
+	err = nil
+	if first < 0 || first > maxLine {
+		err = fmt.Errorf("line %d", first)
+	}
+	c.record("Location::first_line", addr, first, err)
+	err = nil
+	if last < first || last > maxLine {
+		err = fmt.Errorf("last line %d, first line %d", last, first)
+	}
+	c.record("Location::last_line", addr, last, err)
+}
+
+// Check the current offsets. Samples until call_stack
+// is not empty, up to attempts times. If it stays empty, most fields
+// are reported as skipped.
+func (zp *ZeekProcess) Check(attempts int) (*CheckReport, error) {
+	report := &CheckReport{}
+	c := &checker{zp, make(map[string]*CheckResult)}
+	for _, field := range checkFields {
+		result := &CheckResult{Field: field}
+		c.results[field] = result
+		report.Results = append(report.Results, result)
+	}
+
+	version, err := zp.Version()
+	if err == nil && !versionRegexp.MatchString(version) {
+		err = fmt.Errorf("version %q", version)
+	}
+	c.record("version", zp.VersionAddr, fmt.Sprintf("%q", version), err)
+
+	for report.Samples < attempts {
+		report.Samples++
+		done, err := c.checkSample()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return report, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, result := range report.Results {
+		if result.Checked == 0 {
+			result.Detail = fmt.Sprintf("call_stack empty in %d samples", attempts)
+		}
+	}
+	return report, nil
+}
+
+// Check a single sample, returns false if call_stack was empty.
+func (c *checker) checkSample() (bool, error) {
+	zp := c.zp
+	if zp.regions != nil {
+		zp.regions.expire()
+	}
+	if err := zp.mem.Stop(); err != nil {
+		return false, err
+	}
+	defer zp.mem.Resume()
+
+	callVec, err := zp.readVectorSnapshot(zp.CallStackAddr, zp.offsets.CallInfoSize)
+	if err != nil {
+		c.record("call_stack", zp.CallStackAddr, nil, err)
+		return true, nil
+	}
+	if callVec.len() == 0 {
+		return false, nil
+	}
+	c.record("call_stack", zp.CallStackAddr, fmt.Sprintf("%d entries", callVec.len()), nil)
+
+	frameVec, err := zp.readVectorSnapshot(zp.FrameStackAddr, 8)
+	if err == nil && frameVec.len() == 0 {
+		err = fmt.Errorf("empty with %d calls", callVec.len())
+	}
+	if err != nil {
+		c.record("g_frame_stack", zp.FrameStackAddr, nil, err)
+		return true, nil
+	}
+	c.record("g_frame_stack", zp.FrameStackAddr, fmt.Sprintf("%d entries", frameVec.len()), nil)
+
+	o := zp.offsets
+	for i := 0; i < callVec.len(); i++ {
+		addr := callVec.start + uintptr(i*o.CallInfoSize)
+		data := callVec.data[i*o.CallInfoSize:]
+		if funcPtr := uintptr(binary.LittleEndian.Uint64(data[o.CallInfoFunc:])); c.checkPtr("CallInfo::func", addr, funcPtr) {
+			c.checkFunc(funcPtr)
+		}
+		// The call of the first entry is NULL, it has no caller.
+		if i == 0 {
+			continue
+		}
+		if callPtr := uintptr(binary.LittleEndian.Uint64(data[o.CallInfoCall:])); c.checkPtr("CallInfo::call", addr, callPtr) {
+			c.checkObjLocation(callPtr)
+		}
+	}
+
+	if o.FrameNextStmt == 0 {
+		c.skip("Frame::next_stmt", "offset unknown for this build")
+		return true, nil
+	}
+	framePtr := uintptr(binary.LittleEndian.Uint64(frameVec.data[len(frameVec.data)-8:]))
+	if err := c.ptrErr(framePtr); err != nil {
+		c.record("Frame::next_stmt", frameVec.finish-8, nil, fmt.Errorf("Frame pointer %v", err))
+		return true, nil
+	}
+	stmtPtr, err := c.readPtr("Frame", framePtr+uintptr(o.FrameNextStmt))
+	if err != nil {
+		c.record("Frame::next_stmt", framePtr, nil, err)
+		return true, nil
+	}
+	// next_stmt is NULL while a built-in function runs.
+	if stmtPtr == 0 {
+		c.skip("Frame::next_stmt", "NULL in top most frame")
+		return true, nil
+	}
+	if c.checkPtr("Frame::next_stmt", framePtr, stmtPtr) {
+		c.checkObjLocation(stmtPtr)
+	}
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package zeekspy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func checkResult(t *testing.T, report *CheckReport, field string) *CheckResult {
+	t.Helper()
+	for _, r := range report.Results {
+		if r.Field == field {
+			return r
+		}
+	}
+	t.Fatalf("No result for %s", field)
+	return nil
+}
+
+func TestCheckPassed(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.put(0x9000, []byte("3.0.1\x00\x00\x00"))
+	zp.VersionAddr = 0x9000
+	zp.regions = m.regionTable()
+
+	report, err := zp.Check(1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	var out bytes.Buffer
+	report.Write(&out)
+	if !report.Passed() {
+		t.Fatalf("Expected check to pass:\n%s", out.String())
+	}
+	for field, status := range map[string]string{
+		"Func::name":       "PASS",
+		"Frame::next_stmt": "PASS",
+		"CallInfo::call":   "SKIP", // Single entry
+	} {
+		if r := checkResult(t, report, field); r.Status() != status {
+			t.Errorf("Expected %s for %s, got %+v", status, field, r)
+		}
+	}
+	if !strings.Contains(out.String(), `"zeek_init"`) {
+		t.Errorf("Expected function name in report:\n%s", out.String())
+	}
+}
+
+func TestCheckWrongOffsets(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.regions = m.regionTable()
+	offsets := *zp.offsets
+	offsets.FuncName = 16 // points at the name of something else
+	offsets.LocationFirstLine = 20
+	offsets.LocationLastLine = 16
+	zp.offsets = &offsets
+
+	report, err := zp.Check(1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if report.Passed() {
+		t.Fatalf("Expected check to fail")
+	}
+	for _, field := range []string{"version", "Func::name", "Location::last_line"} {
+		if r := checkResult(t, report, field); r.Status() != "FAIL" {
+			t.Errorf("Expected %s to fail, got %+v", field, r)
+		}
+	}
+	if r := checkResult(t, report, "Location::filename"); r.Status() != "PASS" {
+		t.Errorf("Expected Location::filename to pass, got %+v", r)
+	}
+}
+
+func TestCheckEmptyCallStack(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.putPtrs(0x1000, 0x2000, 0x2000, 0x2018)
+	report, err := zp.Check(2)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if report.Samples != 2 {
+		t.Errorf("Expected 2 samples, got %d", report.Samples)
+	}
+	if r := checkResult(t, report, "Func::name"); r.Status() != "SKIP" {
+		t.Errorf("Expected Func::name to be skipped, got %+v", r)
+	}
+}
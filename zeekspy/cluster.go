@@ -0,0 +1,93 @@
+// Cluster nodes of Zeek processes
+//
+// Cluster processes find their node in the CLUSTER_NODE environment
+// variable. zeekctl also passes the node name as the last script prefix,
+// e.g. -p zeekctl -p zeekctl-live -p local -p worker-1-3, which is used
+// if CLUSTER_NODE is not found in /proc/<pid>/environ. Roles follow
+// from the node names zeekctl generates.
+package zeekspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+)
+
+type ClusterNode struct {
+	Name string // e.g. "worker-1-3", "" if not a cluster process
+	Role string // worker, proxy, logger or manager, "" if unknown
+}
+
+var clusterRoles = []string{"worker", "proxy", "logger", "manager"}
+
+// Prefixes zeekctl passes for every node.
+var zeekctlPrefixes = map[string]bool{
+	"zeekctl":      true,
+	"zeekctl-live": true,
+	"broctl":       true,
+	"broctl-live":  true,
+	"local":        true,
+	"standalone":   true,
+}
+
+// Entries of a NUL separated file in /proc/<pid>.
+func readProcStrings(pid int, name string) ([]string, error) {
+	data, err := ioutil.ReadFile(procPath(pid, name))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, s := range bytes.Split(bytes.TrimRight(data, "\x00"), []byte{0}) {
+		result = append(result, string(s))
+	}
+	return result, nil
+}
+
+func nodeFromEnviron(environ []string) string {
+	for _, e := range environ {
+		if strings.HasPrefix(e, "CLUSTER_NODE=") {
+			return strings.TrimPrefix(e, "CLUSTER_NODE=")
+		}
+	}
+	return ""
+}
+
+// The last script prefix not added by zeekctl for every node.
+func nodeFromCmdline(cmdline []string) string {
+	node := ""
+	for i := 1; i < len(cmdline)-1; i++ {
+		if cmdline[i] == "-p" || cmdline[i] == "--prefix" {
+			if p := cmdline[i+1]; !zeekctlPrefixes[p] {
+				node = p
+			}
+			i++
+		}
+	}
+	return node
+}
+
+// The role of a node named by zeekctl, e.g. worker for worker-1-3. Only
+// names starting with the node type are recognized, the type configured
+// in node.cfg is not known here.
+func nodeRole(name string) string {
+	for _, role := range clusterRoles {
+		if name == role || strings.HasPrefix(name, role+"-") {
+			return role
+		}
+	}
+	return ""
+}
+
+// The cluster node of the process, with empty fields where unknown.
+func ProcessClusterNode(pid int) ClusterNode {
+	var name string
+	if environ, err := readProcStrings(pid, "environ"); err == nil {
+		name = nodeFromEnviron(environ)
+	}
+	if name == "" {
+		if cmdline, err := readProcStrings(pid, "cmdline"); err == nil {
+			name = nodeFromCmdline(cmdline)
+		}
+	}
+	return ClusterNode{name, nodeRole(name)}
+}
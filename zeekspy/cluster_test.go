@@ -0,0 +1,60 @@
+package zeekspy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeProcFile(t *testing.T, pid int, name string, data string) {
+	if err := ioutil.WriteFile(filepath.Join(procDir, strconv.Itoa(pid), name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Write a NUL separated file as environ and cmdline.
+func writeProcStrings(t *testing.T, pid int, name string, values ...string) {
+	writeProcFile(t, pid, name, strings.Join(values, "\x00")+"\x00")
+}
+
+func TestProcessClusterNode(t *testing.T) {
+	fakeProc(t, map[int][3]string{
+		10: {"zeek\n", "", ""},
+		11: {"zeek\n", "", ""},
+		12: {"zeek\n", "", ""},
+		13: {"zeek\n", "", ""},
+	})
+	writeProcStrings(t, 10, "environ", "PATH=/usr/bin", "CLUSTER_NODE=worker-1-3")
+	writeProcStrings(t, 11, "environ", "PATH=/usr/bin")
+	writeProcStrings(t, 11, "cmdline", "/opt/zeek/bin/zeek", "-i", "eth0", "-U", ".status",
+		"-p", "zeekctl", "-p", "zeekctl-live", "-p", "local", "-p", "proxy-1", "local.zeek", "zeekctl")
+	writeProcStrings(t, 12, "environ", "CLUSTER_NODE=manager")
+	writeProcStrings(t, 13, "cmdline", "zeek", "-r", "test.pcap", "local")
+
+	for pid, want := range map[int]ClusterNode{
+		10: {"worker-1-3", "worker"},
+		11: {"proxy-1", "proxy"},
+		12: {"manager", "manager"},
+		13: {"", ""},
+		14: {"", ""},
+	} {
+		if node := ProcessClusterNode(pid); node != want {
+			t.Errorf("pid %d: expected %+v, got %+v", pid, want, node)
+		}
+	}
+}
+
+func TestNodeRole(t *testing.T) {
+	for name, want := range map[string]string{
+		"worker-1":    "worker",
+		"logger-2":    "logger",
+		"workers":     "",
+		"my-sensor-1": "",
+	} {
+		if role := nodeRole(name); role != want {
+			t.Errorf("%s: expected %q, got %q", name, want, role)
+		}
+	}
+}
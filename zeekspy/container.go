@@ -0,0 +1,155 @@
+// Zeek processes in containers
+//
+// Paths in /proc/<pid>/exe and /proc/<pid>/maps are those of the mount
+// namespace of the process and may not exist on the host. Files are
+// opened through /proc/<pid>/root instead, or /proc/<pid>/map_files if
+// deleted since they were mapped, e.g. after a package upgrade.
+package zeekspy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Overridden by tests.
+var procDir = "/proc"
+
+func procPath(pid int, elem ...string) string {
+	return filepath.Join(append([]string{procDir, strconv.Itoa(pid)}, elem...)...)
+}
+
+// The executable of the process as seen by it, without deletedSuffix.
+func processExe(pid int) (string, error) {
+	exe, err := os.Readlink(procPath(pid, "exe"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, deletedSuffix), nil
+}
+
+// Set where to open the objects mapped by the process from the host.
+func processObjects(pid int, exe string, objects []mappedObject) []mappedObject {
+	for i := range objects {
+		o := &objects[i]
+		switch {
+		case o.Path == exe:
+			o.File = procPath(pid, "exe")
+		case o.Deleted:
+			o.File = procPath(pid, "map_files", fmt.Sprintf("%x-%x", o.Start, o.End))
+		default:
+			o.File = filepath.Join(procPath(pid, "root"), o.Path)
+		}
+	}
+	return objects
+}
+
+// Find the host PID of the Zeek process in the container with the given
+// ID, or prefix thereof, as found in /proc/<pid>/cgroup. If nspid is not
+// 0, it selects the process by its PID inside the container, otherwise
+// there must be a single process named zeek.
+func FindContainerPid(id string, nspid int) (int, error) {
+	if id == "" {
+		return 0, fmt.Errorf("Empty container ID")
+	}
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !inContainer(pid, id) {
+			continue
+		}
+		if nspid != 0 {
+			if p, ok := namespacePid(pid); ok && p == nspid {
+				return pid, nil
+			}
+			continue
+		}
+		if comm, err := ioutil.ReadFile(procPath(pid, "comm")); err == nil && strings.TrimSpace(string(comm)) == "zeek" {
+			pids = append(pids, pid)
+		}
+	}
+
+	if nspid != 0 {
+		return 0, fmt.Errorf("No process with PID %d in container %s", nspid, id)
+	}
+	switch len(pids) {
+	case 0:
+		return 0, fmt.Errorf("No zeek process in container %s", id)
+	case 1:
+		return pids[0], nil
+	}
+	sort.Ints(pids)
+	return 0, fmt.Errorf("Multiple zeek processes in container %s (%v), select one by its PID inside the container", id, pids)
+}
+
+// Whether a cgroup path of the process has a component naming the
+// container ID or a prefix thereof: /docker/<id> as well as
+// docker-<id>.scope and the like of podman, containerd and CRI-O.
+func inContainer(pid int, id string) bool {
+	data, err := ioutil.ReadFile(procPath(pid, "cgroup"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, c := range strings.Split(fields[2], "/") {
+			if cid, ok := cgroupContainerID(c); ok && strings.HasPrefix(cid, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var cgroupContainerPrefixes = []string{"docker-", "libpod-", "cri-containerd-", "crio-"}
+
+// The container ID in a component of a cgroup path, if any.
+func cgroupContainerID(c string) (string, bool) {
+	c = strings.TrimSuffix(c, ".scope")
+	for _, prefix := range cgroupContainerPrefixes {
+		if strings.HasPrefix(c, prefix) {
+			c = c[len(prefix):]
+			break
+		}
+	}
+	if c == "" {
+		return "", false
+	}
+	for _, r := range c {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return "", false
+		}
+	}
+	return c, true
+}
+
+// The PID of the process in its innermost PID namespace.
+func namespacePid(pid int) (int, bool) {
+	f, err := os.Open(procPath(pid, "status"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "NSpid:" {
+			p, err := strconv.Atoi(fields[len(fields)-1])
+			return p, err == nil
+		}
+	}
+	return 0, false
+}
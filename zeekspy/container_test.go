@@ -0,0 +1,109 @@
+package zeekspy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Create a fake /proc with the given processes.
+func fakeProc(t *testing.T, procs map[int][3]string) {
+	dir := t.TempDir()
+	orig := procDir
+	procDir = dir
+	t.Cleanup(func() { procDir = orig })
+
+	for pid, p := range procs {
+		pidDir := filepath.Join(dir, strconv.Itoa(pid))
+		if err := os.MkdirAll(pidDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range []string{"comm", "cgroup", "status"} {
+			if err := ioutil.WriteFile(filepath.Join(pidDir, name), []byte(p[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFindContainerPid(t *testing.T) {
+	const id = "3f4e8a7c0b21d9e6"
+	cgroup := "0::/system.slice/docker-" + id + "0123.scope\n"
+	fakeProc(t, map[int][3]string{
+		1:    {"systemd\n", "0::/init.scope\n", "NSpid:\t1\n"},
+		4711: {"zeek\n", "0::/user.slice\n", "NSpid:\t4711\n"},
+		5000: {"bash\n", cgroup, "Name:\tbash\nNSpid:\t5000\t1\n"},
+		5001: {"zeek\n", cgroup, "Name:\tzeek\nNSpid:\t5001\t7\n"},
+	})
+
+	if pid, err := FindContainerPid(id[:12], 0); err != nil || pid != 5001 {
+		t.Errorf("Expected 5001, got %d, %v", pid, err)
+	}
+	if pid, err := FindContainerPid(id, 1); err != nil || pid != 5000 {
+		t.Errorf("Expected 5000 for PID 1 in container, got %d, %v", pid, err)
+	}
+	if _, err := FindContainerPid(id, 2); err == nil {
+		t.Errorf("Expected error for unknown PID in container")
+	}
+	if _, err := FindContainerPid("deadbeef", 0); err == nil {
+		t.Errorf("Expected error for unknown container")
+	}
+}
+
+func TestFindContainerPidMultiple(t *testing.T) {
+	cgroup := "0::/kubepods/pod1/cri-containerd-abc123\n"
+	fakeProc(t, map[int][3]string{
+		10: {"zeek\n", cgroup, "NSpid:\t10\t5\n"},
+		11: {"zeek\n", cgroup, "NSpid:\t11\t6\n"},
+	})
+	_, err := FindContainerPid("abc123", 0)
+	if err == nil || !strings.Contains(err.Error(), "[10 11]") {
+		t.Errorf("Expected error listing both processes, got %v", err)
+	}
+}
+
+// IDs only match the start of a container ID, not any part of a path.
+func TestInContainer(t *testing.T) {
+	fakeProc(t, map[int][3]string{
+		1: {"zeek\n", "0::/system.slice/cron.service\n", ""},
+		2: {"zeek\n", "12:pids:/docker/3f4e8a7c0b21\n", ""},
+		3: {"zeek\n", "0::/machine.slice/libpod-3f4e8a7c0b21.scope/container\n", ""},
+	})
+	for _, tc := range []struct {
+		pid  int
+		id   string
+		want bool
+	}{
+		{1, "sys", false},
+		{1, "cron", false},
+		{2, "3f4e", true},
+		{2, "docker", false},
+		{2, "8a7c", false},
+		{3, "3f4e8a7c0b21", true},
+		{3, "libpod", false},
+	} {
+		if got := inContainer(tc.pid, tc.id); got != tc.want {
+			t.Errorf("inContainer(%d, %q) = %v, want %v", tc.pid, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestProcessObjects(t *testing.T) {
+	objects := processObjects(42, "/usr/local/zeek/bin/zeek", []mappedObject{
+		{Path: "/usr/local/zeek/bin/zeek", Start: 0x1000, End: 0x2000},
+		{Path: "/usr/local/zeek/lib/libzeek.so", Start: 0x3000, End: 0x4000},
+		{Path: "/usr/lib/libc.so.6", Deleted: true, Start: 0x5000, End: 0x6000},
+	})
+	for i, want := range []string{
+		"/proc/42/exe",
+		"/proc/42/root/usr/local/zeek/lib/libzeek.so",
+		"/proc/42/map_files/5000-6000",
+	} {
+		if objects[i].File != want {
+			t.Errorf("Expected %s, got %s", want, objects[i].File)
+		}
+	}
+}
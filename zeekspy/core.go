@@ -0,0 +1,358 @@
+// Reading Zeek's memory from an ELF core file
+//
+// The kernel (and gcore) dump a PT_LOAD segment for every mapping of the
+// process. File backed mappings that were never written to, like the text
+// and read-only data of the Zeek binary, usually have no data in the core
+// file. The NT_FILE note records which file was mapped where, so these
+// reads are served from the mapped files instead.
+package zeekspy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	ntPrstatus = 1
+	ntAuxv     = 6
+	ntFile     = 0x46494c45
+
+	atEntry = 9
+
+	// Offset of pr_pid in struct elf_prstatus on x86_64.
+	prstatusPidOffset = 32
+)
+
+// A file mapped into the process, from the NT_FILE note.
+type coreFileMapping struct {
+	Start, End uint64
+	Offset     uint64 // in bytes
+	Name       string
+}
+
+// MemoryReader serving reads from a core file.
+type coreReader struct {
+	core     *elf.File
+	segments []*elf.Prog
+	mappings []coreFileMapping
+	files    map[string]*os.File
+
+	pid   int
+	entry uint64
+}
+
+func newCoreReader(corePath string) (*coreReader, error) {
+	core, err := elf.Open(corePath)
+	if err != nil {
+		return nil, err
+	}
+	if core.Type != elf.ET_CORE {
+		core.Close()
+		return nil, fmt.Errorf("%s is not a core file (%v)", corePath, core.Type)
+	}
+
+	r := &coreReader{core: core, files: make(map[string]*os.File)}
+	for _, prog := range core.Progs {
+		switch prog.Type {
+		case elf.PT_LOAD:
+			r.segments = append(r.segments, prog)
+		case elf.PT_NOTE:
+			data := make([]byte, prog.Filesz)
+			if _, err := prog.ReadAt(data, 0); err != nil {
+				r.Close()
+				return nil, fmt.Errorf("Could not read notes: %v", err)
+			}
+			if err := r.parseNotes(data); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+	}
+	if r.entry == 0 {
+		r.Close()
+		return nil, fmt.Errorf("No AT_ENTRY found in auxv of %s", corePath)
+	}
+	return r, nil
+}
+
+func (r *coreReader) parseNotes(data []byte) error {
+	for _, note := range parseElfNotes(data) {
+		switch note.Type {
+		case ntPrstatus:
+			if r.pid == 0 && len(note.Desc) >= prstatusPidOffset+4 {
+				r.pid = int(binary.LittleEndian.Uint32(note.Desc[prstatusPidOffset:]))
+			}
+		case ntAuxv:
+			r.entry = parseAuxv(note.Desc)[atEntry]
+		case ntFile:
+			mappings, err := parseNtFile(note.Desc)
+			if err != nil {
+				return err
+			}
+			r.mappings = mappings
+		}
+	}
+	return nil
+}
+
+// The mapping containing the program's entry point, that's the executable.
+func (r *coreReader) exeMapping() *coreFileMapping {
+	for i, m := range r.mappings {
+		if r.entry >= m.Start && r.entry < m.End {
+			return &r.mappings[i]
+		}
+	}
+	return nil
+}
+
+// Serve reads of the executable's mappings from exe, e.g. if the core
+// was copied from a different system.
+func (r *coreReader) redirectExe(exe string) {
+	if m := r.exeMapping(); m != nil {
+		name := m.Name
+		for i := range r.mappings {
+			if r.mappings[i].Name == name {
+				r.mappings[i].Name = exe
+			}
+		}
+	}
+}
+
+func (r *coreReader) Stop() error {
+	return nil
+}
+
+func (r *coreReader) Resume() {
+}
+
+// A core file never changes, so it's as good as stopped.
+func (r *coreReader) Stopping() bool {
+	return true
+}
+
+func (r *coreReader) ReadMemory(addr uintptr, data []byte) error {
+	for len(data) > 0 {
+		n, err := r.readChunk(uint64(addr), data)
+		if err != nil {
+			return err
+		}
+		addr += uintptr(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Read as much as possible from a single segment or mapped file.
+func (r *coreReader) readChunk(addr uint64, data []byte) (int, error) {
+	for _, seg := range r.segments {
+		if addr < seg.Vaddr || addr >= seg.Vaddr+seg.Memsz {
+			continue
+		}
+		off := addr - seg.Vaddr
+		if off < seg.Filesz {
+			n := minUint64(uint64(len(data)), seg.Filesz-off)
+			return seg.ReadAt(data[:n], int64(off))
+		}
+		n := minUint64(uint64(len(data)), seg.Memsz-off)
+		if m := r.findMapping(addr); m != nil {
+			n = minUint64(n, m.End-addr)
+			return r.readMapping(m, addr, data[:n])
+		}
+		// Not dumped and not file backed, must have been zero.
+		for i := range data[:n] {
+			data[i] = 0
+		}
+		return int(n), nil
+	}
+
+	if m := r.findMapping(addr); m != nil {
+		n := minUint64(uint64(len(data)), m.End-addr)
+		return r.readMapping(m, addr, data[:n])
+	}
+	return 0, fmt.Errorf("address %#x not in core file", addr)
+}
+
+func (r *coreReader) findMapping(addr uint64) *coreFileMapping {
+	for i, m := range r.mappings {
+		if addr >= m.Start && addr < m.End {
+			return &r.mappings[i]
+		}
+	}
+	return nil
+}
+
+func (r *coreReader) readMapping(m *coreFileMapping, addr uint64, data []byte) (int, error) {
+	f, ok := r.files[m.Name]
+	if !ok {
+		var err error
+		if f, err = os.Open(m.Name); err != nil {
+			return 0, fmt.Errorf("reading %#x: %v", addr, err)
+		}
+		r.files[m.Name] = f
+	}
+	n, err := f.ReadAt(data, int64(m.Offset+addr-m.Start))
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Readable PT_LOAD segments as regions.
+func (r *coreReader) regions() ([]MemoryRegion, error) {
+	var regions []MemoryRegion
+	for _, seg := range r.segments {
+		if seg.Flags&elf.PF_R == 0 {
+			continue
+		}
+		regions = append(regions, MemoryRegion{
+			Start:  uintptr(seg.Vaddr),
+			End:    uintptr(seg.Vaddr + seg.Memsz),
+			Perms:  "r",
+			Offset: seg.Off,
+		})
+	}
+	return regions, nil
+}
+
+func (r *coreReader) Close() error {
+	for _, f := range r.files {
+		f.Close()
+	}
+	return r.core.Close()
+}
+
+type elfNote struct {
+	Name string
+	Type uint32
+	Desc []byte
+}
+
+// Split the content of a PT_NOTE segment into its notes.
+func parseElfNotes(data []byte) []elfNote {
+	var notes []elfNote
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+	for len(data) >= 12 {
+		namesz := binary.LittleEndian.Uint32(data[0:4])
+		descsz := binary.LittleEndian.Uint32(data[4:8])
+		typ := binary.LittleEndian.Uint32(data[8:12])
+		data = data[12:]
+		if uint64(align(namesz))+uint64(align(descsz)) > uint64(len(data)) {
+			break
+		}
+		name := string(bytes.TrimRight(data[:namesz], "\x00"))
+		data = data[align(namesz):]
+		notes = append(notes, elfNote{name, typ, data[:descsz]})
+		data = data[align(descsz):]
+	}
+	return notes
+}
+
+// Parse the NT_AUXV note into a type -> value map.
+func parseAuxv(desc []byte) map[uint64]uint64 {
+	auxv := make(map[uint64]uint64)
+	for ; len(desc) >= 16; desc = desc[16:] {
+		typ := binary.LittleEndian.Uint64(desc[0:8])
+		if typ == 0 { // AT_NULL
+			break
+		}
+		auxv[typ] = binary.LittleEndian.Uint64(desc[8:16])
+	}
+	return auxv
+}
+
+// Parse the NT_FILE note:
+//
+//	count(8), page_size(8)
+//	count * (start(8), end(8), file_ofs(8)) - file_ofs in pages
+//	count * NULL terminated filenames
+func parseNtFile(desc []byte) ([]coreFileMapping, error) {
+	bad := errors.New("bad NT_FILE note")
+	if len(desc) < 16 {
+		return nil, bad
+	}
+	count := binary.LittleEndian.Uint64(desc[0:8])
+	pageSize := binary.LittleEndian.Uint64(desc[8:16])
+	if count > uint64(len(desc)-16)/24 {
+		return nil, bad
+	}
+	entries := desc[16:]
+	names := bytes.Split(entries[count*24:], []byte{0})
+	if uint64(len(names)) < count {
+		return nil, bad
+	}
+
+	mappings := make([]coreFileMapping, count)
+	for i := uint64(0); i < count; i++ {
+		e := entries[i*24:]
+		mappings[i] = coreFileMapping{
+			Start:  binary.LittleEndian.Uint64(e[0:8]),
+			End:    binary.LittleEndian.Uint64(e[8:16]),
+			Offset: binary.LittleEndian.Uint64(e[16:24]) * pageSize,
+			Name:   string(names[i]),
+		}
+	}
+	return mappings, nil
+}
+
+// Open a core file of a Zeek process. exe is the Zeek binary the process
+// was running. If empty, the path recorded in the core file is used.
+func ZeekProcessFromCore(corePath string, exe string) (*ZeekProcess, error) {
+	r, err := newCoreReader(corePath)
+	if err != nil {
+		return nil, err
+	}
+	if exe == "" {
+		m := r.exeMapping()
+		if m == nil {
+			r.Close()
+			return nil, fmt.Errorf("Could not find executable in %s, use an explicit one", corePath)
+		}
+		exe = m.Name
+	} else {
+		r.redirectExe(exe)
+	}
+
+	var mapped []MemoryRegion
+	for _, m := range r.mappings {
+		mapped = append(mapped, MemoryRegion{Start: uintptr(m.Start), End: uintptr(m.End), Offset: m.Offset, Path: m.Name})
+	}
+	obj, err := findZeekObject("", exe, mappedObjects(mapped))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	defer obj.Close()
+
+	// The entry point recorded in auxv tells us where the executable
+	// was loaded, even if NT_FILE is missing.
+	if obj.Path == exe {
+		obj.Bias = uintptr(r.entry - obj.File.Entry)
+	}
+
+	zp := newZeekProcess(r.pid, exe, r, obj)
+	if zp.regions, err = newRegionTable(r.regions); err != nil {
+		zp.Close()
+		return nil, err
+	}
+	if err := zp.loadOffsets(obj.dwarfFile()); err != nil {
+		zp.Close()
+		return nil, err
+	}
+	if err := zp.setStdLib(detectStdLib(obj.File)); err != nil {
+		zp.Close()
+		return nil, err
+	}
+	return zp, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package zeekspy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func le64(values ...uint64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(data[i*8:], v)
+	}
+	return data
+}
+
+func makeNote(name string, typ uint32, desc []byte) []byte {
+	pad := func(b []byte) []byte {
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	hdr := make([]byte, 12)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(name)+1))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(desc)))
+	binary.LittleEndian.PutUint32(hdr[8:], typ)
+	data := append(hdr, pad(append([]byte(name), 0))...)
+	return append(data, pad(desc)...)
+}
+
+func TestParseNotes(t *testing.T) {
+	auxv := le64(3, 0x1040, atEntry, 0x55550000a000, 0, 0)
+	ntFileDesc := append(le64(2, 4096,
+		0x555500000000, 0x555500010000, 0,
+		0x555500010000, 0x555500020000, 16),
+		[]byte("/opt/zeek/bin/zeek\x00/lib/libc.so.6\x00")...)
+
+	data := append(makeNote("CORE", ntAuxv, auxv), makeNote("CORE", ntFile, ntFileDesc)...)
+	notes := parseElfNotes(data)
+	if len(notes) != 2 || notes[0].Name != "CORE" || notes[1].Type != ntFile {
+		t.Fatalf("Unexpected notes %+v", notes)
+	}
+
+	r := &coreReader{}
+	if err := r.parseNotes(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.entry != 0x55550000a000 {
+		t.Errorf("Unexpected entry %#x", r.entry)
+	}
+	if len(r.mappings) != 2 {
+		t.Fatalf("Unexpected mappings %+v", r.mappings)
+	}
+	m := r.mappings[1]
+	if m.Name != "/lib/libc.so.6" || m.Offset != 16*4096 || m.Start != 0x555500010000 {
+		t.Errorf("Unexpected mapping %+v", m)
+	}
+	if exe := r.exeMapping(); exe == nil || exe.Name != "/opt/zeek/bin/zeek" {
+		t.Errorf("Unexpected exe mapping %+v", exe)
+	}
+}
+
+func TestParseNtFileTruncated(t *testing.T) {
+	if _, err := parseNtFile(le64(1000, 4096, 1, 2, 3)); err == nil {
+		t.Errorf("Expected error for truncated NT_FILE")
+	}
+}
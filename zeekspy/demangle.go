@@ -0,0 +1,66 @@
+// Demangling of C++ symbol names
+//
+// Zeek 4 moved call_stack and g_frame_stack into the zeek::detail
+// namespace, so their symbols are mangled. Only what is needed for
+// global variables is supported: plain and nested source names, e.g.
+// _ZN4zeek6detail10call_stackE is zeek::detail::call_stack.
+package zeekspy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Demangle a symbol for a global variable. Returns false for anything
+// else, including functions.
+func demangle(name string) (string, bool) {
+	if !strings.HasPrefix(name, "_Z") {
+		return "", false
+	}
+	rest := name[2:]
+
+	nested := strings.HasPrefix(rest, "N")
+	if nested {
+		rest = rest[1:]
+	}
+
+	var parts []string
+	if strings.HasPrefix(rest, "St") { // std::
+		parts = append(parts, "std")
+		rest = rest[2:]
+	}
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		part, remaining, ok := sourceName(rest)
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, part)
+		rest = remaining
+		if !nested {
+			break
+		}
+	}
+	if nested {
+		if !strings.HasPrefix(rest, "E") {
+			return "", false
+		}
+		rest = rest[1:]
+	}
+	if rest != "" || len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "::"), true
+}
+
+// Parse <length><identifier> at the start of s.
+func sourceName(s string) (string, string, bool) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n == 0 || i+n > len(s) {
+		return "", "", false
+	}
+	return s[i : i+n], s[i+n:], true
+}
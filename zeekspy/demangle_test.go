@@ -0,0 +1,32 @@
+package zeekspy
+
+import (
+	"testing"
+)
+
+func TestDemangle(t *testing.T) {
+	for name, want := range map[string]string{
+		"_ZN4zeek6detail10call_stackE":    "zeek::detail::call_stack",
+		"_ZN4zeek6detail13g_frame_stackE": "zeek::detail::g_frame_stack",
+		"_Z10call_stack":                  "call_stack",
+		"_ZSt4cout":                       "std::cout",
+		"_ZNSt8ios_base4InitE":            "std::ios_base::Init",
+	} {
+		if got, ok := demangle(name); !ok || got != want {
+			t.Errorf("demangle(%s) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+
+	for _, name := range []string{
+		"call_stack",
+		"_Z",
+		"_ZN4zeek6detail10call_stack", // missing E
+		"_ZN4zeek6detail99call_stackE",
+		"_ZN4zeek4initEv", // function
+		"_Z4initv",
+	} {
+		if got, ok := demangle(name); ok {
+			t.Errorf("demangle(%s) = %q, expected failure", name, got)
+		}
+	}
+}
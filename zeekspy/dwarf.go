@@ -0,0 +1,218 @@
+// Struct offsets from DWARF debug info
+//
+// If the Zeek binary has debug info, sizes and member offsets of the
+// objects we read are taken from there instead of structOffsetsMap.
+// This is what NOTES.md describes doing by hand with dwarfdump.
+package zeekspy
+
+import (
+	"debug/dwarf"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A class or struct definition found in the debug info.
+type dwarfStruct struct {
+	size    int64
+	members map[string]int64
+}
+
+// Classes and the members we need of them, by their Zeek 3 names.
+var dwarfClasses = map[string][]string{
+	"Location": {"filename", "first_line", "last_line"},
+	"BroObj":   {"location"},
+	"Func":     {"kind", "name"},
+	"Frame":    {"next_stmt"},
+	"CallInfo": {"call", "func"},
+}
+
+// Names of the classes since Zeek 4, preferred if present.
+var dwarfModernNames = map[string]string{
+	"Location": "zeek::detail::Location",
+	"BroObj":   "zeek::Obj",
+	"Func":     "zeek::Func",
+	"Frame":    "zeek::detail::Frame",
+	"CallInfo": "zeek::detail::CallInfo",
+}
+
+// Find the definitions of the given (namespace qualified) classes. The
+// first definition found wins. Children of anything but compile units
+// and namespaces are skipped, so this stays reasonably fast for huge
+// binaries. Stops early once done returns true, or all were found if
+// done is nil.
+func readDwarfStructs(d *dwarf.Data, wanted map[string][]string,
+	done func(found map[string]*dwarfStruct) bool) (map[string]*dwarfStruct, error) {
+	found := make(map[string]*dwarfStruct)
+	if done == nil {
+		done = func(found map[string]*dwarfStruct) bool { return len(found) == len(wanted) }
+	}
+	var scope []string
+
+	r := d.Reader()
+	for !done(found) {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+
+		switch e.Tag {
+		case 0:
+			if len(scope) > 0 {
+				scope = scope[:len(scope)-1]
+			}
+			continue
+		case dwarf.TagCompileUnit, dwarf.TagNamespace:
+			if e.Children {
+				name, _ := e.Val(dwarf.AttrName).(string)
+				if e.Tag == dwarf.TagCompileUnit {
+					name = ""
+				}
+				scope = append(scope, name)
+			}
+			continue
+		case dwarf.TagClassType, dwarf.TagStructType:
+			name := qualifiedName(scope, e)
+			_, want := wanted[name]
+			decl, _ := e.Val(dwarf.AttrDeclaration).(bool)
+			size, ok := e.Val(dwarf.AttrByteSize).(int64)
+			if want && found[name] == nil && !decl && ok && e.Children {
+				s, err := readDwarfMembers(r)
+				if err != nil {
+					return nil, err
+				}
+				s.size = size
+				found[name] = s
+				continue
+			}
+		}
+		r.SkipChildren()
+	}
+	return found, nil
+}
+
+func qualifiedName(scope []string, e *dwarf.Entry) string {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	var parts []string
+	for _, s := range scope {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(append(parts, name), "::")
+}
+
+// Read the members following a class entry, up to its terminating entry.
+func readDwarfMembers(r *dwarf.Reader) (*dwarfStruct, error) {
+	s := &dwarfStruct{members: make(map[string]int64)}
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Tag == 0 {
+			return s, nil
+		}
+		if e.Tag == dwarf.TagMember {
+			name, _ := e.Val(dwarf.AttrName).(string)
+			if offset, ok := memberOffset(e.Val(dwarf.AttrDataMemberLoc)); ok {
+				s.members[name] = offset
+			}
+		}
+		r.SkipChildren()
+	}
+}
+
+// DW_AT_data_member_location is a constant since DWARF 3, older
+// compilers emit a DW_OP_plus_uconst location expression.
+func memberOffset(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case []byte:
+		if len(v) > 1 && v[0] == 0x23 { // DW_OP_plus_uconst
+			offset, n := binary.Uvarint(v[1:])
+			return int64(offset), n > 0
+		}
+	}
+	return 0, false
+}
+
+// Compute StructOffsets from the debug info of a Zeek binary.
+func offsetsFromDwarf(d *dwarf.Data) (*StructOffsets, error) {
+	wanted := make(map[string][]string)
+	for class, members := range dwarfClasses {
+		wanted[class] = members
+		if modern, ok := dwarfModernNames[class]; ok {
+			wanted[modern] = members
+		}
+	}
+	// Zeek 3 and Zeek 4 names are not mixed.
+	done := func(found map[string]*dwarfStruct) bool {
+		legacy, modern := true, true
+		for class := range dwarfClasses {
+			legacy = legacy && found[class] != nil
+			modern = modern && found[dwarfModernNames[class]] != nil
+		}
+		return legacy || modern
+	}
+	found, err := readDwarfStructs(d, wanted, done)
+	if err != nil {
+		return nil, err
+	}
+	structs := make(map[string]*dwarfStruct)
+	for class := range dwarfClasses {
+		if s := found[dwarfModernNames[class]]; s != nil {
+			structs[class] = s
+		} else {
+			structs[class] = found[class]
+		}
+	}
+
+	var missing []string
+	member := func(class, name string) int {
+		if s := structs[class]; s != nil {
+			if offset, ok := s.members[name]; ok {
+				return int(offset)
+			}
+		}
+		missing = append(missing, class+"::"+name)
+		return 0
+	}
+	optionalMember := func(class, name string) int {
+		if s := structs[class]; s != nil {
+			return int(s.members[name])
+		}
+		return 0
+	}
+	size := func(class string) int {
+		if s := structs[class]; s != nil {
+			return int(s.size)
+		}
+		missing = append(missing, class)
+		return 0
+	}
+
+	offsets := &StructOffsets{
+		LocationSize:      size("Location"),
+		LocationFilename:  member("Location", "filename"),
+		LocationFirstLine: member("Location", "first_line"),
+		LocationLastLine:  member("Location", "last_line"),
+		ObjLocation:       member("BroObj", "location"),
+		FuncKind:          member("Func", "kind"),
+		FuncName:          member("Func", "name"),
+		FrameNextStmt:     optionalMember("Frame", "next_stmt"),
+		CallInfoSize:      size("CallInfo"),
+		CallInfoCall:      member("CallInfo", "call"),
+		CallInfoFunc:      member("CallInfo", "func"),
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("Missing in debug info: %s", strings.Join(missing, ", "))
+	}
+	return offsets, nil
+}
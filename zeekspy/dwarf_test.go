@@ -0,0 +1,110 @@
+package zeekspy
+
+import (
+	"debug/elf"
+	"strings"
+	"testing"
+)
+
+func TestOffsetsFromDwarf(t *testing.T) {
+	f, err := elf.Open("testdata/dwarf/layout.o")
+	if err != nil {
+		t.Fatalf("Could not open layout.o: %v", err)
+	}
+	defer f.Close()
+	d, err := f.DWARF()
+	if err != nil {
+		t.Fatalf("Could not read DWARF: %v", err)
+	}
+
+	offsets, err := offsetsFromDwarf(d)
+	if err != nil {
+		t.Fatalf("offsetsFromDwarf failed: %v", err)
+	}
+	if want := structOffsetsMap["3.0"]; *offsets != *want {
+		t.Errorf("Expected %+v, got %+v", want, offsets)
+	}
+
+	structs, err := readDwarfStructs(d, map[string][]string{"other::Location": nil, "Missing": nil}, nil)
+	if err != nil {
+		t.Fatalf("readDwarfStructs failed: %v", err)
+	}
+	if s := structs["other::Location"]; s == nil || s.members["filename"] != 100 {
+		t.Errorf("Unexpected other::Location %+v", s)
+	}
+	if structs["Missing"] != nil {
+		t.Errorf("Unexpected Missing %+v", structs["Missing"])
+	}
+}
+
+func TestOffsetsFromDwarfMissing(t *testing.T) {
+	f, err := elf.Open("testdata/dwarf/layout.o")
+	if err != nil {
+		t.Fatalf("Could not open layout.o: %v", err)
+	}
+	defer f.Close()
+	d, err := f.DWARF()
+	if err != nil {
+		t.Fatalf("Could not read DWARF: %v", err)
+	}
+
+	// Pretend CallInfo is not in the debug info.
+	saved := dwarfClasses["CallInfo"]
+	delete(dwarfClasses, "CallInfo")
+	defer func() { dwarfClasses["CallInfo"] = saved }()
+
+	if _, err := offsetsFromDwarf(d); err == nil || !strings.Contains(err.Error(), "CallInfo::call") {
+		t.Errorf("Expected error about CallInfo::call, got %v", err)
+	}
+}
+
+func TestOffsetsFromDwarfZeek4(t *testing.T) {
+	f, err := elf.Open("testdata/dwarf/libzeek-layout.so.0")
+	if err != nil {
+		t.Fatalf("Could not open libzeek-layout.so.0: %v", err)
+	}
+	defer f.Close()
+	d, err := f.DWARF()
+	if err != nil {
+		t.Fatalf("Could not read DWARF: %v", err)
+	}
+
+	offsets, err := offsetsFromDwarf(d)
+	if err != nil {
+		t.Fatalf("offsetsFromDwarf failed: %v", err)
+	}
+	want := StructOffsets{
+		LocationSize:      24,
+		LocationFilename:  0,
+		LocationFirstLine: 8,
+		LocationLastLine:  12,
+		ObjLocation:       8,
+		FuncKind:          56,
+		FuncName:          72,
+		FrameNextStmt:     200,
+		CallInfoSize:      24,
+		CallInfoCall:      0,
+		CallInfoFunc:      8,
+	}
+	if *offsets != want {
+		t.Errorf("Expected %+v, got %+v", want, offsets)
+	}
+}
+
+func TestMemberOffset(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want int64
+		ok   bool
+	}{
+		{int64(144), 144, true},
+		{[]byte{0x23, 0x90, 0x01}, 144, true}, // DW_OP_plus_uconst 144
+		{[]byte{0x10, 0x08}, 0, false},
+		{nil, 0, false},
+	} {
+		got, ok := memberOffset(tc.v)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("memberOffset(%v) = %d, %v, want %d, %v", tc.v, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Errors while sampling
+//
+// Errors from Spy() of a live process are one of the following, which
+// decides whether sampling can go on:
+//
+//	ProcessExitedError   the process is gone
+//	PermissionError      not allowed to trace the process or read its memory
+//	LayoutMismatchError  the struct offsets do not match the process, see maps.go
+//	TransientError       anything else, e.g. an interrupted syscall, ESRCH
+//	                     while a thread of the process exits, or a bad read
+//
+// Only transient errors are worth sampling again.
+package zeekspy
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+type ProcessExitedError struct {
+	Pid int
+}
+
+func (e *ProcessExitedError) Error() string {
+	return fmt.Sprintf("process %d exited", e.Pid)
+}
+
+type PermissionError struct {
+	Pid int
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("not permitted to trace process %d: %v (running as root? see also /proc/sys/kernel/yama/ptrace_scope)",
+		e.Pid, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return fmt.Sprintf("transient error: %v", e.Err)
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Whether sampling may succeed again after err.
+func IsTransient(err error) bool {
+	var transient *TransientError
+	return errors.As(err, &transient)
+}
+
+// Turn an error of sampling pid into one of the errors above.
+func classifyError(pid int, err error) error {
+	var (
+		exited    *ProcessExitedError
+		perm      *PermissionError
+		mismatch  *LayoutMismatchError
+		transient *TransientError
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exited), errors.As(err, &perm), errors.As(err, &mismatch), errors.As(err, &transient):
+		return err
+	case !processAlive(pid):
+		// Reading a zombie's memory fails with EPERM, too.
+		return &ProcessExitedError{pid}
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return &PermissionError{pid, err}
+	}
+	return &TransientError{err}
+}
@@ -0,0 +1,73 @@
+package zeekspy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	fakeProc(t, map[int][3]string{
+		10: {"zeek\n", "", ""},
+		11: {"zeek\n", "", ""},
+	})
+	writeProcFile(t, 10, "stat", fakeStat(10, 1, "zeek", 4711))
+	writeProcFile(t, 11, "stat", strings.Replace(fakeStat(11, 1, "zeek", 4711), " S ", " Z ", 1))
+
+	var (
+		exited    *ProcessExitedError
+		perm      *PermissionError
+		mismatch  *LayoutMismatchError
+		transient *TransientError
+	)
+	for _, tc := range []struct {
+		pid    int
+		err    error
+		target interface{}
+	}{
+		{10, syscall.EPERM, &perm},
+		{10, fmt.Errorf("read at 0x1000: %w", syscall.EACCES), &perm},
+		{10, syscall.ESRCH, &transient},
+		{10, syscall.EINTR, &transient},
+		{10, errors.New("short read at 0x1000: 4 of 8 bytes"), &transient},
+		{10, &LayoutMismatchError{"Func", 0x1000, "length 12345678"}, &mismatch},
+		{11, syscall.ESRCH, &exited},
+		{11, syscall.EPERM, &exited},
+		{11, fmt.Errorf("read at 0x1000: %w", syscall.EACCES), &exited},
+		{12, syscall.ESRCH, &exited},
+		{12, &ProcessExitedError{12}, &exited},
+	} {
+		err := classifyError(tc.pid, tc.err)
+		if !errors.As(err, tc.target) {
+			t.Errorf("pid %d, %v: unexpected %T", tc.pid, tc.err, err)
+		}
+		if IsTransient(err) != (tc.target == &transient) {
+			t.Errorf("pid %d, %v: IsTransient() is %v", tc.pid, tc.err, IsTransient(err))
+		}
+	}
+
+	if err := classifyError(10, nil); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
+
+// Core files and snapshots have the PID of a process that is likely gone
+// or reused.
+func TestSpyErrorsNotLive(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.Pid = 12
+	delete(m.regions, 0x1000) // call_stack
+	_, err := zp.Spy()
+	var exited *ProcessExitedError
+	if err == nil || errors.As(err, &exited) || IsTransient(err) {
+		t.Errorf("Expected the error unchanged, got %T %v", err, err)
+	}
+
+	zp.live = true
+	fakeProc(t, map[int][3]string{})
+	if _, err := zp.Spy(); !errors.As(err, &exited) {
+		t.Errorf("Expected ProcessExitedError, got %T %v", err, err)
+	}
+}
@@ -0,0 +1,181 @@
+// Matching layouts to Zeek builds
+//
+// The same Zeek version built with another compiler or for another
+// architecture may lay out its objects differently. Layouts are
+// matched by build-id first, then by version prefix, compiler and
+// architecture. Compiler and architecture of a layout are optional.
+package zeekspy
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// What identifies a Zeek build for layout matching.
+type Fingerprint struct {
+	BuildID  string
+	Version  string
+	Compiler string // e.g. "GCC 8.3.0" or "clang 10.0.0", "" if unknown
+	Arch     string // e.g. "x86_64", "" if unknown
+}
+
+func (fp *Fingerprint) String() string {
+	var parts []string
+	for _, p := range []string{fp.Version, fp.Compiler, fp.Arch} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if fp.BuildID != "" {
+		parts = append(parts, "build-id "+fp.BuildID)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	gccCommentRegexp   = regexp.MustCompile(`^GCC: \(.*\) (\d[\d.]*)`)
+	clangCommentRegexp = regexp.MustCompile(`clang version (\d[\d.]*)`)
+)
+
+// The compiler f was built with according to its .comment section.
+// Static builds also list the compilers of libraries and C runtime
+// objects, usually GCC. Any mention of clang wins, as for detectStdLib.
+func elfCompiler(f *elf.File) string {
+	s := f.Section(".comment")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+	gcc := ""
+	for _, comment := range bytes.Split(data, []byte{0}) {
+		if m := clangCommentRegexp.FindSubmatch(comment); m != nil {
+			return "clang " + string(m[1])
+		}
+		if m := gccCommentRegexp.FindSubmatch(comment); m != nil && gcc == "" {
+			gcc = "GCC " + string(m[1])
+		}
+	}
+	return gcc
+}
+
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64",
+	elf.EM_AARCH64: "aarch64",
+	elf.EM_386:     "i386",
+	elf.EM_ARM:     "arm",
+}
+
+func elfArch(f *elf.File) string {
+	if arch, ok := elfArchs[f.Machine]; ok {
+		return arch
+	}
+	return strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))
+}
+
+// A layout to match against and where it is from.
+type layoutCandidate struct {
+	*Layout
+	Source string // "layout file" or "built-in"
+}
+
+// Layouts for versions, from layout files before built-in ones.
+func layoutCandidates() []layoutCandidate {
+	var candidates []layoutCandidate
+	for i := range loadedLayouts {
+		if loadedLayouts[i].Version != "" {
+			candidates = append(candidates, layoutCandidate{&loadedLayouts[i], "layout file"})
+		}
+	}
+	builtin := BuiltinLayouts()
+	for i := range builtin.Layouts {
+		candidates = append(candidates, layoutCandidate{&builtin.Layouts[i], "built-in"})
+	}
+	return candidates
+}
+
+// Why c does not match fp, or "" if it does.
+func (c *layoutCandidate) mismatch(fp *Fingerprint) string {
+	switch {
+	case c.BuildID != "" && c.BuildID != fp.BuildID:
+		return fmt.Sprintf("build-id %s", c.BuildID)
+	case !strings.HasPrefix(fp.Version, c.Version):
+		return fmt.Sprintf("version %s", c.Version)
+	case c.Compiler != "" && fp.Compiler != "" && !strings.HasPrefix(fp.Compiler, c.Compiler):
+		return fmt.Sprintf("compiler %s", c.Compiler)
+	case c.Arch != "" && fp.Arch != "" && c.Arch != fp.Arch:
+		return fmt.Sprintf("architecture %s", c.Arch)
+	}
+	return ""
+}
+
+// Describe what c matched on.
+func (c *layoutCandidate) reason() string {
+	reason := fmt.Sprintf("version %s", c.Version)
+	if c.Compiler != "" {
+		reason += ", compiler " + c.Compiler
+	}
+	if c.Arch != "" {
+		reason += ", " + c.Arch
+	}
+	return reason
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Number of closest candidates listed when nothing matches.
+const closestCandidates = 3
+
+// Pick the most specific candidate matching fp: layout files before
+// built-in ones, then by length of the version prefix and compiler.
+// Returns the match and why it was chosen, or an error listing the
+// closest candidates.
+func matchLayout(fp *Fingerprint, candidates []layoutCandidate) (*layoutCandidate, string, error) {
+	var best *layoutCandidate
+	better := func(c *layoutCandidate) bool {
+		if best.Source != c.Source {
+			return c.Source == "layout file"
+		}
+		if len(c.Version) != len(best.Version) {
+			return len(c.Version) > len(best.Version)
+		}
+		return len(c.Compiler)+len(c.Arch) > len(best.Compiler)+len(best.Arch)
+	}
+	for i := range candidates {
+		c := &candidates[i]
+		if c.mismatch(fp) == "" && (best == nil || better(c)) {
+			best = c
+		}
+	}
+	if best != nil {
+		return best, best.reason(), nil
+	}
+
+	closest := make([]layoutCandidate, len(candidates))
+	copy(closest, candidates)
+	sort.SliceStable(closest, func(i, j int) bool {
+		return commonPrefixLen(fp.Version, closest[i].Version) > commonPrefixLen(fp.Version, closest[j].Version)
+	})
+	if len(closest) > closestCandidates {
+		closest = closest[:closestCandidates]
+	}
+	var lines []string
+	for _, c := range closest {
+		lines = append(lines, fmt.Sprintf("  %s (%s): %s does not match", c.reason(), c.Source, c.mismatch(fp)))
+	}
+	return nil, "", fmt.Errorf("No struct offsets for %s, closest candidates:\n%s\n"+
+		"Use a layout file, see `zeek-spy probe` and `zeek-spy layout dump`",
+		fp, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,74 @@
+package zeekspy
+
+import (
+	"debug/elf"
+	"strings"
+	"testing"
+)
+
+func TestElfCompilerAndArch(t *testing.T) {
+	f, err := elf.Open("testdata/dwarf/layout.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if c := elfCompiler(f); !strings.HasPrefix(c, "GCC ") {
+		t.Errorf("Unexpected compiler %q", c)
+	}
+	if a := elfArch(f); a != "x86_64" {
+		t.Errorf("Unexpected architecture %q", a)
+	}
+}
+
+func TestMatchLayout(t *testing.T) {
+	gcc8 := Layout{Version: "3.0", Compiler: "GCC 8", Offsets: StructOffsets{FuncName: 1}}
+	clang := Layout{Version: "3.0", Compiler: "clang", Offsets: StructOffsets{FuncName: 2}}
+	arm := Layout{Version: "3.0.1", Arch: "aarch64", Offsets: StructOffsets{FuncName: 3}}
+	candidates := []layoutCandidate{
+		{&gcc8, "layout file"},
+		{&clang, "layout file"},
+		{&arm, "layout file"},
+		{&Layout{Version: "3.0", Compiler: "GCC", Arch: "x86_64"}, "built-in"},
+	}
+
+	for _, tc := range []struct {
+		fp     Fingerprint
+		want   *Layout
+		reason string
+	}{
+		{Fingerprint{Version: "3.0.1", Compiler: "GCC 8.3.0", Arch: "x86_64"}, &gcc8, "version 3.0, compiler GCC 8"},
+		{Fingerprint{Version: "3.0.1", Compiler: "clang 10.0.0", Arch: "x86_64"}, &clang, "version 3.0, compiler clang"},
+		{Fingerprint{Version: "3.0.1", Compiler: "GCC 12.2.0", Arch: "aarch64"}, &arm, "version 3.0.1, aarch64"},
+		{Fingerprint{Version: "3.0.1", Compiler: "GCC 12.2.0", Arch: "x86_64"}, candidates[3].Layout, "version 3.0, compiler GCC, x86_64"},
+	} {
+		match, reason, err := matchLayout(&tc.fp, candidates)
+		if err != nil {
+			t.Errorf("%s: %v", tc.fp.String(), err)
+			continue
+		}
+		if match.Layout != tc.want || reason != tc.reason {
+			t.Errorf("%s: unexpected match %+v (%s)", tc.fp.String(), match.Layout, reason)
+		}
+	}
+}
+
+func TestMatchLayoutClosest(t *testing.T) {
+	fp := &Fingerprint{Version: "3.0.1", Compiler: "clang 10.0.0", Arch: "x86_64"}
+	_, _, err := matchLayout(fp, layoutCandidates())
+	if err == nil {
+		t.Fatalf("Expected no match for %s", fp.String())
+	}
+	msg := err.Error()
+	for _, want := range []string{"3.0.1, clang 10.0.0, x86_64", "version 3.0, compiler GCC, x86_64 (built-in): compiler GCC does not match"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected %q in error:\n%s", want, msg)
+		}
+	}
+	want := closestCandidates
+	if n := len(layoutCandidates()); n < want {
+		want = n
+	}
+	if strings.Count(msg, "does not match") != want {
+		t.Errorf("Expected %d candidates:\n%s", want, msg)
+	}
+}
@@ -0,0 +1,175 @@
+// Starting Zeek under the profiler
+//
+// The child is started traced, so it stops at its execve() before
+// running any code. It is then stopped every millisecond until Zeek's
+// symbols can be resolved, which may require libzeek.so to be loaded,
+// and detached from, leaving it stopped. A reader attaches again for
+// sampling as for any other process and the child is only resumed once
+// that is done, so sampling starts before any script runs.
+package zeekspy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// How often the child is stopped to check for Zeek's symbols.
+const launchPollInterval = time.Millisecond
+
+// Error for a child that exited before its symbols were found.
+type ChildExitError struct {
+	Pid    int
+	Status syscall.WaitStatus
+}
+
+func (e *ChildExitError) Error() string {
+	return fmt.Sprintf("Process %d exited with status %d before Zeek was found", e.Pid, ExitCode(e.Status))
+}
+
+// Exit code of a shell for a process with this wait status.
+func ExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// Start argv in its own process group and return its pid once Zeek's
+// symbols can be resolved. The child is stopped and no longer traced,
+// ResumeChild continues it. It needs to be reaped with WaitChild, unless
+// a reader did already.
+//
+// Must be called from a locked OS thread, the child is traced by the
+// calling thread until detached. See the runtime.LockOSThread() in main.
+func StartZeek(argv []string) (int, error) {
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return 0, err
+	}
+	proc, err := os.StartProcess(path, argv, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Ptrace: true, Setpgid: true},
+	})
+	if err != nil {
+		return 0, err
+	}
+	pid := proc.Pid
+	proc.Release()
+
+	mapped := -1
+	for {
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+			return 0, err
+		}
+		if status.Exited() || status.Signaled() {
+			return 0, &ChildExitError{pid, status}
+		}
+		if !status.Stopped() {
+			continue
+		}
+
+		// SIGTRAP after execve() or our SIGSTOP. Forward anything else.
+		sig := status.StopSignal()
+		if sig != syscall.SIGTRAP && sig != syscall.SIGSTOP {
+			if err := syscall.PtraceCont(pid, int(sig)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if found, n := zeekSymbolsMapped(pid, mapped); found {
+			return pid, detachStopped(pid)
+		} else {
+			mapped = n
+		}
+		if err := syscall.PtraceCont(pid, 0); err != nil {
+			return 0, err
+		}
+		time.Sleep(launchPollInterval)
+		if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Whether Zeek's symbols can be found in the objects mapped by pid.
+func HasZeekSymbols(pid int) bool {
+	found, _ := zeekSymbolsMapped(pid, -1)
+	return found
+}
+
+// Detach from the traced child with SIGSTOP and wait until that put it
+// into a group-stop.
+func detachStopped(pid int) error {
+	if err := ptraceRequest(syscall.PTRACE_DETACH, pid, uintptr(syscall.SIGSTOP)); err != nil {
+		return err
+	}
+	for {
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WUNTRACED, nil); err != nil {
+			return err
+		}
+		if status.Exited() || status.Signaled() {
+			return &ChildExitError{pid, status}
+		}
+		if status.Stopped() {
+			return nil
+		}
+	}
+}
+
+// Whether Zeek's symbols are in one of the objects mapped by pid.
+// Objects are only searched if their number differs from mapped. Also
+// returns the number of objects.
+func zeekSymbolsMapped(pid int, mapped int) (bool, int) {
+	exe, err := processExe(pid)
+	if err != nil {
+		return false, mapped
+	}
+	regions, err := readMaps(pid)
+	if err != nil {
+		return false, mapped
+	}
+	objects := processObjects(pid, exe, mappedObjects(regions))
+	if len(objects) == mapped {
+		return false, mapped
+	}
+	obj, err := findZeekObject(procPath(pid, "root"), exe, objects)
+	if err != nil {
+		return false, len(objects)
+	}
+	obj.Close()
+	return true, len(objects)
+}
+
+// Continue a child started with StartZeek.
+func ResumeChild(pid int) error {
+	return syscall.Kill(pid, syscall.SIGCONT)
+}
+
+// Reap a child started with StartZeek.
+func WaitChild(pid int) (syscall.WaitStatus, error) {
+	var status syscall.WaitStatus
+	for {
+		if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+			return status, err
+		}
+		if status.Exited() || status.Signaled() {
+			return status, nil
+		}
+	}
+}
+
+// Kill a child started with StartZeek along with its process group and
+// reap it.
+func KillChild(pid int) error {
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+		return err
+	}
+	_, err := WaitChild(pid)
+	return err
+}
@@ -0,0 +1,97 @@
+package zeekspy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A child without Zeek symbols is polled until it exits.
+func TestStartZeekChildExits(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	_, err := StartZeek([]string{"sh", "-c", "sleep 0.05; exit 3"})
+	var exit *ChildExitError
+	if !errors.As(err, &exit) {
+		t.Fatalf("Expected ChildExitError, got %v", err)
+	}
+	if code := ExitCode(exit.Status); code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+}
+
+// The child stays stopped after its symbols were found until resumed.
+func TestStartZeekStopped(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	lib, err := filepath.Abs(testLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LD_PRELOAD", lib)
+	pid, err := StartZeek([]string{"sleep", "10"})
+	if err != nil {
+		t.Fatalf("StartZeek failed: %v", err)
+	}
+	defer KillChild(pid)
+
+	state := func() string {
+		data, err := ioutil.ReadFile(procPath(pid, "stat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// State follows the parenthesized comm.
+		return strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))[0]
+	}
+	if s := state(); s != "T" {
+		t.Errorf("Expected child to be stopped, state %s", s)
+	}
+	if err := ResumeChild(pid); err != nil {
+		t.Fatalf("ResumeChild failed: %v", err)
+	}
+	for i := 0; i < 100 && state() == "T"; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if s := state(); s == "T" {
+		t.Errorf("Expected child to run, state %s", s)
+	}
+}
+
+func TestStartZeekNotFound(t *testing.T) {
+	if _, err := StartZeek([]string{"./no-such-zeek"}); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	// Wait status as encoded by the kernel.
+	if code := ExitCode(syscall.WaitStatus(2 << 8)); code != 2 {
+		t.Errorf("Expected 2, got %d", code)
+	}
+	if code := ExitCode(syscall.WaitStatus(syscall.SIGTERM)); code != 143 {
+		t.Errorf("Expected 143, got %d", code)
+	}
+}
+
+func TestKillChild(t *testing.T) {
+	proc, err := os.StartProcess("/bin/sh", []string{"sh", "-c", "sleep 10"}, &os.ProcAttr{
+		Sys: &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := KillChild(proc.Pid); err != nil {
+		t.Fatalf("KillChild failed: %v", err)
+	}
+	if err := syscall.Kill(proc.Pid, 0); err != syscall.ESRCH {
+		t.Errorf("Expected child to be gone, got %v", err)
+	}
+}
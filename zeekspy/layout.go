@@ -0,0 +1,213 @@
+// Layout definitions loadable at runtime
+//
+// A layout file adds StructOffsets for Zeek builds not covered by
+// structOffsetsMap without recompiling zeek-spy. Entries are keyed by
+// version prefix and optionally the GNU build-id of the Zeek binary:
+//
+//	{
+//	  "Layouts": [
+//	    {
+//	      "Version": "3.0",
+//	      "BuildID": "8f3a...",
+//	      "Offsets": {"LocationSize": 24, ...}
+//	    }
+//	  ]
+//	}
+//
+// `zeek-spy layout dump` prints the built-in entries in this format.
+package zeekspy
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// StructOffsets for Zeek builds whose version starts with Version and,
+// if set, whose binary has the given build-id, was built by a compiler
+// starting with Compiler (e.g. "GCC 8") and for architecture Arch.
+type Layout struct {
+	Version  string
+	BuildID  string `json:",omitempty"`
+	Compiler string `json:",omitempty"`
+	Arch     string `json:",omitempty"`
+	Offsets  StructOffsets
+}
+
+type LayoutFile struct {
+	Layouts []Layout
+}
+
+// Layouts from layout files, preferred over structOffsetsMap.
+var loadedLayouts []Layout
+
+// Read a layout file and use its entries for Zeek processes opened
+// afterwards. Entries of later files take precedence.
+func LoadLayoutFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lf, err := ReadLayoutFile(f)
+	if err != nil {
+		return fmt.Errorf("Could not parse layout file %s: %v", path, err)
+	}
+	loadedLayouts = append(lf.Layouts, loadedLayouts...)
+	return nil
+}
+
+func ReadLayoutFile(r io.Reader) (*LayoutFile, error) {
+	var lf LayoutFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lf); err != nil {
+		return nil, err
+	}
+	for i, l := range lf.Layouts {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("layout %d: %v", i, err)
+		}
+	}
+	return &lf, nil
+}
+
+func (l *Layout) validate() error {
+	if l.Version == "" && l.BuildID == "" {
+		return fmt.Errorf("Version or BuildID required")
+	}
+	return l.Offsets.validate()
+}
+
+// Upper bound for the offsets of Func members, the object is far smaller.
+const maxFuncOffset = 4096
+
+// Check that the members are within their structs, so that decoding
+// never slices out of bounds.
+func (o *StructOffsets) validate() error {
+	for name, off := range map[string]int{
+		"LocationSize":      o.LocationSize,
+		"LocationFilename":  o.LocationFilename,
+		"LocationFirstLine": o.LocationFirstLine,
+		"LocationLastLine":  o.LocationLastLine,
+		"ObjLocation":       o.ObjLocation,
+		"FuncKind":          o.FuncKind,
+		"FuncName":          o.FuncName,
+		"FrameNextStmt":     o.FrameNextStmt,
+		"CallInfoSize":      o.CallInfoSize,
+		"CallInfoCall":      o.CallInfoCall,
+		"CallInfoFunc":      o.CallInfoFunc,
+	} {
+		if off < 0 {
+			return fmt.Errorf("negative %s %d", name, off)
+		}
+	}
+	if o.LocationSize <= 0 || o.CallInfoSize <= 0 {
+		return fmt.Errorf("LocationSize and CallInfoSize required")
+	}
+	if o.LocationFilename+8 > o.LocationSize || o.LocationFirstLine+4 > o.LocationSize ||
+		o.LocationLastLine+4 > o.LocationSize {
+		return fmt.Errorf("Location members exceed LocationSize")
+	}
+	if o.CallInfoCall+8 > o.CallInfoSize || o.CallInfoFunc+8 > o.CallInfoSize {
+		return fmt.Errorf("CallInfo members exceed CallInfoSize")
+	}
+	if o.FuncKind+4 > maxFuncOffset || o.ObjLocation+8 > maxFuncOffset || o.FuncName > maxFuncOffset {
+		return fmt.Errorf("Func members exceed %d bytes", maxFuncOffset)
+	}
+	if o.StdLib != "" {
+		if _, err := stdLibraryByName(o.StdLib); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The entries of structOffsetsMap as a LayoutFile.
+func BuiltinLayouts() *LayoutFile {
+	lf := &LayoutFile{}
+	for version, offsets := range structOffsetsMap {
+		lf.Layouts = append(lf.Layouts, Layout{
+			Version:  version,
+			Compiler: structOffsetsCompilers[version],
+			Arch:     builtinArch,
+			Offsets:  *offsets,
+		})
+	}
+	sort.Slice(lf.Layouts, func(i, j int) bool { return lf.Layouts[i].Version < lf.Layouts[j].Version })
+	return lf
+}
+
+// Layout of the Zeek build whose debug info is in path, either the
+// binary or its separate debug file (e.g. from a -dbg package). It is
+// keyed by the build-id, which the stripped binary shares.
+func LayoutFromDebugInfo(path, version string) (*Layout, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("No debug info in %s: %v", path, err)
+	}
+	offsets, err := offsetsFromDwarf(d)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read offsets from %s: %v", path, err)
+	}
+	l := &Layout{
+		Version:  version,
+		BuildID:  elfBuildID(f),
+		Compiler: elfCompiler(f),
+		Arch:     elfArch(f),
+		Offsets:  *offsets,
+	}
+	if err := l.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid offsets in %s: %v", path, err)
+	}
+	return l, nil
+}
+
+func (lf *LayoutFile) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(lf)
+}
+
+// Loaded layout for exactly this build-id.
+func layoutForBuildID(buildID string) *StructOffsets {
+	if buildID == "" {
+		return nil
+	}
+	for i := range loadedLayouts {
+		l := &loadedLayouts[i]
+		if l.BuildID == buildID {
+			return &l.Offsets
+		}
+	}
+	return nil
+}
+
+// Hex encoded GNU build-id of f, or "" if it has none.
+func elfBuildID(f *elf.File) string {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+	for _, note := range parseElfNotes(data) {
+		if note.Type == 3 && note.Name == "GNU" { // NT_GNU_BUILD_ID
+			return hex.EncodeToString(note.Desc)
+		}
+	}
+	return ""
+}
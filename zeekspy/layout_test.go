@@ -0,0 +1,105 @@
+package zeekspy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayoutDumpRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := BuiltinLayouts().Write(&buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	lf, err := ReadLayoutFile(&buf)
+	if err != nil {
+		t.Fatalf("ReadLayoutFile failed: %v", err)
+	}
+	if len(lf.Layouts) != len(structOffsetsMap) {
+		t.Fatalf("Expected %d layouts, got %d", len(structOffsetsMap), len(lf.Layouts))
+	}
+	for _, l := range lf.Layouts {
+		if want := structOffsetsMap[l.Version]; want == nil || l.Offsets != *want {
+			t.Errorf("Unexpected layout %+v", l)
+		}
+	}
+}
+
+func TestReadLayoutFileInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown field": `{"Layouts": [{"Version": "3.0", "Offsets": {"LocationSise": 24}}]}`,
+		"no version":    `{"Layouts": [{"Offsets": {"LocationSize": 24, "CallInfoSize": 24}}]}`,
+		"no sizes":      `{"Layouts": [{"Version": "3.0", "Offsets": {}}]}`,
+		"out of bounds": `{"Layouts": [{"Version": "3.0", "Offsets": {"LocationSize": 8, "LocationLastLine": 8, "CallInfoSize": 24}}]}`,
+		"negative kind": `{"Layouts": [{"Version": "3.0", "Offsets": {"LocationSize": 24, "CallInfoSize": 24, "FuncKind": -4}}]}`,
+		"negative file": `{"Layouts": [{"Version": "3.0", "Offsets": {"LocationSize": 24, "CallInfoSize": 24, "LocationFilename": -8}}]}`,
+		"huge name":     `{"Layouts": [{"Version": "3.0", "Offsets": {"LocationSize": 24, "CallInfoSize": 24, "FuncName": 1099511627776}}]}`,
+	} {
+		if _, err := ReadLayoutFile(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLoadOffsetsFromLayoutFile(t *testing.T) {
+	defer func() { loadedLayouts = nil }()
+
+	custom := *structOffsetsMap["3.0"]
+	custom.FrameNextStmt = 152
+	byBuildID := custom
+	byBuildID.FrameNextStmt = 160
+	lf := &LayoutFile{[]Layout{
+		{Version: "3.0.1", Offsets: custom},
+		{Version: "3.0", BuildID: "abcd", Offsets: byBuildID},
+	}}
+	path := filepath.Join(t.TempDir(), "layout.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := LoadLayoutFile(path); err != nil {
+		t.Fatalf("LoadLayoutFile failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		version, buildID string
+		want             *StructOffsets
+		source           string
+	}{
+		{"3.0.1", "", &custom, "layout file"},
+		{"3.0.1", "abcd", &byBuildID, "layout file (build-id)"},
+		{"3.0.2", "", structOffsetsMap["3.0"], "built-in"},
+		{"3.0.2", "ffff", structOffsetsMap["3.0"], "built-in"},
+	} {
+		zp, m := newFakeZeek()
+		m.put(0x9000, []byte(tc.version+"\x00\x00\x00"))
+		zp.VersionAddr = 0x9000
+		zp.BuildID = tc.buildID
+		if err := zp.loadOffsets(nil); err != nil {
+			t.Fatalf("loadOffsets failed: %v", err)
+		}
+		if !reflect.DeepEqual(zp.offsets, tc.want) || zp.OffsetsSource != tc.source {
+			t.Errorf("%s/%s: got %+v from %s", tc.version, tc.buildID, zp.offsets, zp.OffsetsSource)
+		}
+	}
+}
+
+func TestLayoutFromDebugInfo(t *testing.T) {
+	l, err := LayoutFromDebugInfo("testdata/dwarf/layout.o", "3.0.1")
+	if err != nil {
+		t.Fatalf("LayoutFromDebugInfo failed: %v", err)
+	}
+	if l.Version != "3.0.1" || l.Offsets != *structOffsetsMap["3.0"] {
+		t.Errorf("Unexpected layout %+v", l)
+	}
+	if _, err := LayoutFromDebugInfo("testdata/dwarf/layout.cc", "3.0.1"); err == nil {
+		t.Errorf("Expected error for a file that is not ELF")
+	}
+}
@@ -0,0 +1,160 @@
+// Memory mappings of the process and pointer validation
+//
+// Everything read from the Zeek process is checked against its readable
+// mappings before following it. A pointer outside of them, a huge vector
+// or an endless string most likely means the StructOffsets do not match
+// the Zeek binary and is reported as a LayoutMismatchError.
+package zeekspy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Longest string we are willing to read, filenames are bounded by PATH_MAX.
+const maxStringLen = 4096
+
+// One line of /proc/<pid>/maps.
+type MemoryRegion struct {
+	Start, End uintptr
+	Perms      string
+	Offset     uint64
+	Inode      uint64
+	Path       string
+}
+
+func (r *MemoryRegion) Readable() bool {
+	return strings.HasPrefix(r.Perms, "r")
+}
+
+// Reading memory of the process produced data that does not match the
+// expected layout.
+type LayoutMismatchError struct {
+	What   string // What we were reading, e.g. "Func"
+	Addr   uintptr
+	Reason string
+}
+
+func (e *LayoutMismatchError) Error() string {
+	return fmt.Sprintf("layout mismatch reading %s at %#x: %s (offsets probably wrong for this Zeek build)",
+		e.What, e.Addr, e.Reason)
+}
+
+func parseMaps(r io.Reader) ([]MemoryRegion, error) {
+	var regions []MemoryRegion
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			return nil, fmt.Errorf("bad maps line %q", scanner.Text())
+		}
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		inode, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, MemoryRegion{
+			Start:  uintptr(start),
+			End:    uintptr(end),
+			Perms:  fields[1],
+			Offset: offset,
+			Inode:  inode,
+			Path:   strings.Join(fields[5:], " "),
+		})
+	}
+	return regions, scanner.Err()
+}
+
+func readMaps(pid int) ([]MemoryRegion, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMaps(f)
+}
+
+// Readable regions of the process, sorted by address. If a pointer is
+// not found, the regions are reloaded once per sample as the process
+// may have mapped new memory since.
+type regionTable struct {
+	regions []MemoryRegion
+	reload  func() ([]MemoryRegion, error)
+	fresh   bool
+}
+
+func newRegionTable(reload func() ([]MemoryRegion, error)) (*regionTable, error) {
+	t := &regionTable{reload: reload}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *regionTable) load() error {
+	regions, err := t.reload()
+	if err != nil {
+		return err
+	}
+	readable := regions[:0]
+	for _, r := range regions {
+		if r.Readable() {
+			readable = append(readable, r)
+		}
+	}
+	sort.Slice(readable, func(i, j int) bool { return readable[i].Start < readable[j].Start })
+	t.regions = readable
+	t.fresh = true
+	return nil
+}
+
+// Is [addr, addr+size) covered by readable regions?
+func (t *regionTable) covers(addr uintptr, size int) bool {
+	end := addr + uintptr(size)
+	if end < addr {
+		return false
+	}
+	for addr < end {
+		i := sort.Search(len(t.regions), func(i int) bool { return t.regions[i].End > addr })
+		if i == len(t.regions) || t.regions[i].Start > addr {
+			return false
+		}
+		addr = t.regions[i].End
+	}
+	return true
+}
+
+func (t *regionTable) check(addr uintptr, size int) bool {
+	if t.covers(addr, size) {
+		return true
+	}
+	if t.fresh || t.load() != nil {
+		return false
+	}
+	return t.covers(addr, size)
+}
+
+// Called for every sample, allowing a reload.
+func (t *regionTable) expire() {
+	t.fresh = false
+}
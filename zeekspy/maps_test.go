@@ -0,0 +1,83 @@
+package zeekspy
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMaps = `55f9a6665000-55f9a6800000 r--p 00000000 fd:01 1234  /opt/zeek/bin/zeek
+55f9a6800000-55f9a7000000 r-xp 0019b000 fd:01 1234  /opt/zeek/bin/zeek
+55f9a7000000-55f9a7400000 rw-p 0099b000 fd:01 1234  /opt/zeek/bin/zeek
+55f9a7400000-55f9a7500000 ---p 00000000 00:00 0
+55f9a7500000-55f9a7600000 rw-p 00000000 00:00 0     [heap]
+7f0000000000-7f0000001000 r--p 00000000 fd:01 99    /tmp/with space (deleted)
+`
+
+func TestParseMaps(t *testing.T) {
+	regions, err := parseMaps(strings.NewReader(testMaps))
+	if err != nil {
+		t.Fatalf("parseMaps failed: %v", err)
+	}
+	if len(regions) != 6 {
+		t.Fatalf("Expected 6 regions, got %d", len(regions))
+	}
+	r := regions[1]
+	if r.Start != 0x55f9a6800000 || r.End != 0x55f9a7000000 || r.Perms != "r-xp" || r.Offset != 0x19b000 || r.Inode != 1234 {
+		t.Errorf("Unexpected region %+v", r)
+	}
+	if regions[3].Path != "" || regions[3].Readable() {
+		t.Errorf("Unexpected anonymous region %+v", regions[3])
+	}
+	if regions[5].Path != "/tmp/with space (deleted)" {
+		t.Errorf("Unexpected path %q", regions[5].Path)
+	}
+	objects := mappedObjects(regions)
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 objects, got %+v", objects)
+	}
+	if o := objects[0]; o.Path != "/opt/zeek/bin/zeek" || o.Start != 0x55f9a6665000 || o.Offset != 0 {
+		t.Errorf("Unexpected object %+v", o)
+	}
+	if o := objects[1]; o.Path != "/tmp/with space" || !o.Deleted || o.End != 0x7f0000001000 {
+		t.Errorf("Unexpected deleted object %+v", o)
+	}
+}
+
+func TestRegionTableCovers(t *testing.T) {
+	loads := 0
+	table, err := newRegionTable(func() ([]MemoryRegion, error) {
+		loads++
+		return parseMaps(strings.NewReader(testMaps))
+	})
+	if err != nil {
+		t.Fatalf("newRegionTable failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		addr uintptr
+		size int
+		want bool
+	}{
+		{0x55f9a6665000, 8, true},
+		{0x55f9a67ffffc, 8, true},  // spans two adjacent regions
+		{0x55f9a73ffffc, 8, false}, // into the ---p region
+		{0x55f9a7500000, 0x100000, true},
+		{0x55f9a7500000, 0x100001, false},
+		{0x1000, 8, false},
+		{^uintptr(0) - 4, 8, false},
+	} {
+		if got := table.check(tc.addr, tc.size); got != tc.want {
+			t.Errorf("check(%#x, %d) = %v, want %v", tc.addr, tc.size, got, tc.want)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected no reload within a sample, got %d loads", loads)
+	}
+
+	table.expire()
+	table.check(0x1000, 8)
+	table.check(0x2000, 8)
+	if loads != 2 {
+		t.Errorf("Expected a single reload per sample, got %d loads", loads)
+	}
+}
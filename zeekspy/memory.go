@@ -0,0 +1,385 @@
+// Reading memory of a remote process
+//
+// A MemoryReader hides how memory of the Zeek process is accessed. The
+// ptrace reader stops the process for every sample using PTRACE_ATTACH,
+// the seize reader attaches once and uses PTRACE_INTERRUPT for every
+// sample and the vmreadv reader uses process_vm_readv(2) and never
+// stops the process.
+package zeekspy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Attach to the process for every sample and read using ptrace(2).
+	ReaderPtrace = "ptrace"
+	// Seize the process once and interrupt it for every sample.
+	ReaderSeize = "seize"
+	// Read using process_vm_readv(2) without ever stopping the process.
+	ReaderVmReadv = "vmreadv"
+)
+
+// Names of all available readers, in order of preference.
+var ReaderKinds = []string{ReaderPtrace, ReaderSeize, ReaderVmReadv}
+
+type MemoryReader interface {
+	// Stop the process so that its memory can be read. Readers
+	// that do not need to stop the process do nothing here.
+	Stop() error
+
+	// Let the process continue after Stop().
+	Resume()
+
+	// Does Stop() actually stop the process?
+	Stopping() bool
+
+	// Fill data with the memory of the process starting at addr.
+	ReadMemory(addr uintptr, data []byte) error
+}
+
+// Implemented by readers that count the syscalls they issue.
+type syscallCounter interface {
+	Syscalls() uint64
+}
+
+func countSyscalls(r MemoryReader) uint64 {
+	if c, ok := r.(syscallCounter); ok {
+		return c.Syscalls()
+	}
+	return 0
+}
+
+// Implemented by readers that wait for the process and may reap it if
+// it is our child.
+type exitRecorder interface {
+	exitStatus() (syscall.WaitStatus, bool)
+}
+
+// Wait status of an exited process.
+type reapedStatus struct {
+	status syscall.WaitStatus
+	reaped bool
+}
+
+func (r *reapedStatus) record(status syscall.WaitStatus) {
+	r.status, r.reaped = status, true
+}
+
+func (r *reapedStatus) exitStatus() (syscall.WaitStatus, bool) {
+	return r.status, r.reaped
+}
+
+func newMemoryReader(kind string, pid int) (MemoryReader, error) {
+	switch kind {
+	case "", ReaderPtrace:
+		return &ptraceReader{pid: pid, mem: procMemory{pid: pid}}, nil
+	case ReaderSeize:
+		return &seizeReader{pid: pid, mem: procMemory{pid: pid}}, nil
+	case ReaderVmReadv:
+		if sysProcessVmReadv == 0 {
+			return nil, fmt.Errorf("reader %s is not supported on %s", kind, runtime.GOARCH)
+		}
+		return &vmReadvReader{pid: pid}, nil
+	}
+	return nil, fmt.Errorf("unknown reader %q (use one of %v)", kind, ReaderKinds)
+}
+
+// Reads memory of a stopped tracee. Uses /proc/<pid>/mem, needing a single
+// pread(2) per read, and falls back to PTRACE_PEEKDATA which needs one
+// syscall per word.
+type procMemory struct {
+	pid      int
+	file     *os.File
+	noFile   bool
+	syscalls uint64
+}
+
+func (m *procMemory) ReadMemory(addr uintptr, data []byte) error {
+	if m.file == nil && !m.noFile {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/mem", m.pid))
+		if err != nil {
+			log.Printf("[WARN] Using PTRACE_PEEKDATA: %v\n", err)
+			m.noFile = true
+		}
+		m.file = f
+	}
+
+	if m.file != nil {
+		m.syscalls++
+		if _, err := m.file.ReadAt(data, int64(addr)); err != nil {
+			return fmt.Errorf("read at %#x: %w", addr, err)
+		}
+		return nil
+	}
+
+	m.syscalls += uint64(((addr+uintptr(len(data))+7)&^7)-(addr&^7)) / 8
+	count, err := syscall.PtracePeekData(m.pid, addr, data)
+	if err != nil {
+		return err
+	}
+	if count != len(data) {
+		return fmt.Errorf("short read at %#x: %d of %d bytes", addr, count, len(data))
+	}
+	return nil
+}
+
+func (m *procMemory) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+// wait4(2) for pid, restarted if interrupted.
+func wait4(pid int, status *syscall.WaitStatus) error {
+	for {
+		_, err := syscall.Wait4(pid, status, 0, nil)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Attach / wait / detach dance for every sample.
+type ptraceReader struct {
+	pid      int
+	mem      procMemory
+	syscalls uint64
+	reapedStatus
+}
+
+func (r *ptraceReader) Stop() error {
+	r.syscalls += 2
+	if err := syscall.PtraceAttach(r.pid); err != nil {
+		return err
+	}
+	if err := r.wait(); err != nil {
+		log.Printf("[WARN] wait() failed for %d: %v\n", r.pid, err)
+		r.Resume()
+		return err
+	}
+	return nil
+}
+
+func (r *ptraceReader) wait() error {
+	var status syscall.WaitStatus
+	if err := wait4(r.pid, &status); err != nil {
+		return err
+	}
+	if status.Exited() || status.Signaled() {
+		r.record(status)
+		return &ProcessExitedError{r.pid}
+	}
+	if !status.Stopped() {
+		return errors.New("process did not stop")
+	}
+	return nil
+}
+
+func (r *ptraceReader) Resume() {
+	r.syscalls++
+	if err := syscall.PtraceDetach(r.pid); err != nil {
+		log.Printf("[WARN] Could not detach from process: %v\n", err)
+	}
+}
+
+func (r *ptraceReader) Stopping() bool {
+	return true
+}
+
+func (r *ptraceReader) ReadMemory(addr uintptr, data []byte) error {
+	return r.mem.ReadMemory(addr, data)
+}
+
+func (r *ptraceReader) Syscalls() uint64 {
+	return r.syscalls + r.mem.syscalls
+}
+
+func (r *ptraceReader) Close() error {
+	return r.mem.Close()
+}
+
+// ptrace(2) requests the syscall package does not provide.
+const (
+	ptraceSeize     = 0x4206
+	ptraceInterrupt = 0x4207
+	ptraceListen    = 0x4208
+
+	ptraceEventStop = 128
+)
+
+func ptraceRequest(request int, pid int, data uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(request), uintptr(pid), 0, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Seize the process once with PTRACE_SEIZE, then use PTRACE_INTERRUPT and
+// PTRACE_CONT for every sample. Unlike PTRACE_ATTACH, this does not send
+// a SIGSTOP to the process for every sample.
+//
+// As long as we are tracing the process, every signal it receives stops
+// it until we forward the signal. This happens in Stop(), so signals are
+// delayed by up to one sampling period. Close() must be called to forward
+// pending signals and detach, otherwise they are lost.
+type seizeReader struct {
+	pid       int
+	mem       procMemory
+	syscalls  uint64
+	seized    bool
+	groupStop bool // Process is in a job control stop, use PTRACE_LISTEN
+	reapedStatus
+}
+
+func (r *seizeReader) Stop() error {
+	if !r.seized {
+		r.syscalls++
+		if err := ptraceRequest(ptraceSeize, r.pid, 0); err != nil {
+			return err
+		}
+		r.seized = true
+	}
+	r.syscalls++
+	if err := ptraceRequest(ptraceInterrupt, r.pid, 0); err != nil {
+		return err
+	}
+	return r.wait()
+}
+
+// Wait for the stop caused by PTRACE_INTERRUPT, forwarding any signals
+// that arrive in the meantime.
+func (r *seizeReader) wait() error {
+	for {
+		var status syscall.WaitStatus
+		r.syscalls++
+		if err := wait4(r.pid, &status); err != nil {
+			return err
+		}
+		if status.Exited() || status.Signaled() {
+			r.seized = false
+			r.record(status)
+			return &ProcessExitedError{r.pid}
+		}
+		if !status.Stopped() {
+			continue
+		}
+
+		sig := status.StopSignal()
+		if int(status>>16) == ptraceEventStop {
+			// Our interrupt if SIGTRAP, otherwise a group-stop
+			// because of SIGSTOP, SIGTSTP or friends.
+			r.groupStop = sig != syscall.SIGTRAP
+			return nil
+		}
+
+		// Signal-delivery-stop: Let the process have its signal, the
+		// interrupt is still pending and reported afterwards.
+		r.syscalls++
+		if err := syscall.PtraceCont(r.pid, int(sig)); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *seizeReader) Resume() {
+	var err error
+	r.syscalls++
+	if r.groupStop {
+		// Keep the job control stop in effect.
+		err = ptraceRequest(ptraceListen, r.pid, 0)
+	} else {
+		err = syscall.PtraceCont(r.pid, 0)
+	}
+	if err != nil {
+		log.Printf("[WARN] Could not resume process: %v\n", err)
+	}
+}
+
+func (r *seizeReader) Stopping() bool {
+	return true
+}
+
+func (r *seizeReader) ReadMemory(addr uintptr, data []byte) error {
+	return r.mem.ReadMemory(addr, data)
+}
+
+func (r *seizeReader) Syscalls() uint64 {
+	return r.syscalls + r.mem.syscalls
+}
+
+// Forward pending signals and detach. The process needs to be stopped
+// for PTRACE_DETACH.
+func (r *seizeReader) Close() error {
+	r.mem.Close()
+	if !r.seized {
+		return nil
+	}
+	if err := r.Stop(); err != nil {
+		return err
+	}
+	r.seized = false
+	return syscall.PtraceDetach(r.pid)
+}
+
+// process_vm_readv(2) based reader. The process keeps running while
+// reading, so the data may change underneath us.
+type vmReadvReader struct {
+	pid      int
+	syscalls uint64
+}
+
+// struct iovec with a remote address that must not be treated as a Go
+// pointer.
+type remoteIovec struct {
+	Base uintptr
+	Len  int
+}
+
+func (r *vmReadvReader) Stop() error {
+	return nil
+}
+
+func (r *vmReadvReader) Resume() {
+}
+
+func (r *vmReadvReader) Stopping() bool {
+	return false
+}
+
+func (r *vmReadvReader) ReadMemory(addr uintptr, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	local := syscall.Iovec{Base: &data[0]}
+	local.SetLen(len(data))
+	remote := remoteIovec{Base: addr, Len: len(data)}
+
+	r.syscalls++
+	n, _, errno := syscall.Syscall6(sysProcessVmReadv,
+		uintptr(r.pid),
+		uintptr(unsafe.Pointer(&local)), 1,
+		uintptr(unsafe.Pointer(&remote)), 1,
+		0)
+	if errno != 0 {
+		return errno
+	}
+	if int(n) != len(data) {
+		return fmt.Errorf("short read at %#x: %d of %d bytes", addr, n, len(data))
+	}
+	return nil
+}
+
+func (r *vmReadvReader) Syscalls() uint64 {
+	return r.syscalls
+}
@@ -0,0 +1,5 @@
+package zeekspy
+
+// process_vm_readv(2) syscall number, the syscall package does not
+// provide it for amd64.
+const sysProcessVmReadv = 310
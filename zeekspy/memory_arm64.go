@@ -0,0 +1,5 @@
+package zeekspy
+
+import "syscall"
+
+const sysProcessVmReadv = syscall.SYS_PROCESS_VM_READV
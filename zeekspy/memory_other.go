@@ -0,0 +1,7 @@
+//go:build !amd64 && !arm64
+
+package zeekspy
+
+// process_vm_readv(2) is not wired up for this architecture, the
+// vmreadv reader is unavailable.
+const sysProcessVmReadv = 0
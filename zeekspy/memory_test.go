@@ -0,0 +1,81 @@
+package zeekspy
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestVmReadvReaderSelf(t *testing.T) {
+	r, err := newMemoryReader(ReaderVmReadv, os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("zeek-spy reading its own memory")
+	got := make([]byte, len(want))
+	if err := r.ReadMemory(addrOf(want), got); err != nil {
+		t.Fatalf("ReadMemory failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestUnknownReader(t *testing.T) {
+	if _, err := newMemoryReader("carrier-pigeon", 1); err == nil {
+		t.Errorf("Expected error for unknown reader")
+	}
+}
+
+func addrOf(b []byte) uintptr {
+	return uintptr(unsafe.Pointer(&b[0]))
+}
+
+// Interrupt a child process a few times and check that a signal sent to
+// it in between is forwarded.
+func TestSeizeReaderForwardsSignals(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	dir := t.TempDir()
+	ready, marker := filepath.Join(dir, "ready"), filepath.Join(dir, "got-usr1")
+	cmd := exec.Command("sh", "-c", `trap "touch `+marker+`" USR1; touch `+ready+`; while :; do sleep 0.01; done`)
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Could not start shell: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	r := &seizeReader{pid: cmd.Process.Pid}
+	if err := r.Stop(); err != nil {
+		t.Skipf("Could not seize child: %v", err)
+	}
+	r.Resume()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(ready); err != nil && time.Now().Before(deadline); _, err = os.Stat(ready) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGUSR1)
+	for time.Now().Before(deadline) {
+		if err := r.Stop(); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+		r.Resume()
+		if _, err := os.Stat(marker); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("SIGUSR1 was not forwarded")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
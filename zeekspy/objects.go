@@ -0,0 +1,270 @@
+// Objects mapped into the process and their symbols
+//
+// call_stack and friends may live in the executable or in a shared
+// library such as libzeek.so. Every mapped object is a candidate. The
+// bias to add to symbol values is computed from the object's PT_LOAD
+// program headers and one of its mappings. Stripped objects are
+// complemented by separate debug files found via build-id or
+// .gnu_debuglink.
+package zeekspy
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Separate debug files are looked up below this directory.
+var debugFileDir = "/usr/lib/debug"
+
+// The kernel appends this to paths of files deleted since mapped.
+const deletedSuffix = " (deleted)"
+
+// A file mapped into the process: where one of its mappings starts and
+// ends and the file offset mapped there.
+type mappedObject struct {
+	Path    string // As seen by the process
+	Deleted bool
+	Start   uintptr
+	End     uintptr
+	Offset  uint64
+
+	// Where to open the file, if not at Path.
+	File string
+}
+
+// The mapped objects in regions, one per path using the mapping with
+// the lowest file offset. Anonymous and special mappings are skipped.
+func mappedObjects(regions []MemoryRegion) []mappedObject {
+	var objects []mappedObject
+	index := make(map[string]int)
+	for _, r := range regions {
+		if !strings.HasPrefix(r.Path, "/") {
+			continue
+		}
+		if i, ok := index[r.Path]; ok {
+			if r.Offset < objects[i].Offset {
+				objects[i].Start, objects[i].End, objects[i].Offset = r.Start, r.End, r.Offset
+			}
+			continue
+		}
+		index[r.Path] = len(objects)
+		path := strings.TrimSuffix(r.Path, deletedSuffix)
+		objects = append(objects, mappedObject{
+			Path:    path,
+			Deleted: path != r.Path,
+			Start:   r.Start,
+			End:     r.End,
+			Offset:  r.Offset,
+		})
+	}
+	return objects
+}
+
+func (o mappedObject) file() string {
+	if o.File != "" {
+		return o.File
+	}
+	return o.Path
+}
+
+// Compute the bias of f, mapped at start from file offset offset: the
+// difference between runtime addresses and the virtual addresses in
+// its program headers and symbols. This is 0 for non-PIE executables.
+func objectBias(f *elf.File, start uintptr, offset uint64) (uintptr, error) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		align := p.Align
+		if align == 0 {
+			align = 1
+		}
+		if p.Off&^(align-1) <= offset && offset < p.Off+p.Filesz {
+			return start - uintptr(p.Vaddr) + uintptr(p.Off) - uintptr(offset), nil
+		}
+	}
+	return 0, fmt.Errorf("No PT_LOAD segment for file offset %#x", offset)
+}
+
+// The object Zeek's globals were found in.
+type zeekObject struct {
+	Path    string
+	File    *elf.File
+	Symbols *zeekSymbols
+	Bias    uintptr
+
+	// Separate debug file, if the object has no debug info itself.
+	Debug     *elf.File
+	DebugPath string
+}
+
+// The debug info to use, if any.
+func (o *zeekObject) dwarfFile() *elf.File {
+	if o.Debug != nil {
+		return o.Debug
+	}
+	return o.File
+}
+
+func (o *zeekObject) Close() {
+	o.File.Close()
+	if o.Debug != nil {
+		o.Debug.Close()
+	}
+}
+
+// Search the executable and all objects for call_stack. libzeek
+// libraries are tried before anything else. Symbols of separate debug
+// files are only considered if no object exports them. Debug files are
+// looked up below root, the root directory of the process.
+func findZeekObject(root, exe string, objects []mappedObject) (*zeekObject, error) {
+	var candidates []mappedObject
+	exeFound := false
+	for _, o := range objects {
+		if o.Path == exe {
+			candidates = append([]mappedObject{o}, candidates...)
+			exeFound = true
+		}
+	}
+	if !exeFound {
+		candidates = append(candidates, mappedObject{Path: exe, File: filepath.Join(root, exe)})
+	}
+	for _, o := range objects {
+		if o.Path != exe && strings.HasPrefix(filepath.Base(o.Path), "libzeek") {
+			candidates = append(candidates, o)
+		}
+	}
+	for _, o := range objects {
+		if o.Path != exe && !strings.HasPrefix(filepath.Base(o.Path), "libzeek") {
+			candidates = append(candidates, o)
+		}
+	}
+
+	var exeErr error
+	for _, withDebug := range []bool{false, true} {
+		for _, c := range candidates {
+			obj, err := openZeekObject(root, c, withDebug)
+			if err == nil {
+				return obj, nil
+			}
+			if c.Path == exe && exeErr == nil {
+				exeErr = err
+			}
+		}
+	}
+	return nil, exeErr
+}
+
+func openZeekObject(root string, c mappedObject, withDebug bool) (*zeekObject, error) {
+	f, err := elf.Open(c.file())
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %v: %v", c.Path, err)
+	}
+	obj := &zeekObject{Path: c.Path, File: f}
+
+	obj.Symbols, err = findZeekSymbols(f)
+	if err != nil && !withDebug {
+		f.Close()
+		return nil, fmt.Errorf("%v in %s", err, c.Path)
+	}
+	if err != nil || f.Section(".debug_info") == nil {
+		obj.DebugPath, obj.Debug = openDebugFile(root, c.Path, f)
+	}
+	if err != nil {
+		if obj.Debug != nil {
+			obj.Symbols, err = findZeekSymbols(obj.Debug)
+		}
+		if err != nil {
+			obj.Close()
+			return nil, fmt.Errorf("%v in %s", err, c.Path)
+		}
+	}
+
+	obj.Bias, err = objectBias(f, c.Start, c.Offset)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("%v in %s", err, c.Path)
+	}
+	return obj, nil
+}
+
+// Find the separate debug file of the object at path. Files below root
+// are preferred, the build-id also identifies debug files installed on
+// the host. Returns the path and the opened file, or nil if there is none.
+func openDebugFile(root, path string, f *elf.File) (string, *elf.File) {
+	buildID := elfBuildID(f)
+	if len(buildID) > 2 {
+		for _, dir := range []string{filepath.Join(root, debugFileDir), debugFileDir} {
+			debugPath := filepath.Join(dir, ".build-id", buildID[:2], buildID[2:]+".debug")
+			if d, err := elf.Open(debugPath); err == nil {
+				if elfBuildID(d) == buildID {
+					return debugPath, d
+				}
+				d.Close()
+			}
+		}
+	}
+
+	name, crc, ok := debugLink(f)
+	if !ok {
+		return "", nil
+	}
+	dir := filepath.Dir(path)
+	for _, debugPath := range []string{
+		filepath.Join(root, dir, name),
+		filepath.Join(root, dir, ".debug", name),
+		filepath.Join(root, debugFileDir, dir, name),
+	} {
+		if debugPath == filepath.Join(root, path) || !checkCRC(debugPath, crc) {
+			continue
+		}
+		d, err := elf.Open(debugPath)
+		if err != nil {
+			log.Printf("[WARN] Could not open debug file %s: %v", debugPath, err)
+			continue
+		}
+		return debugPath, d
+	}
+	return "", nil
+}
+
+// Contents of the .gnu_debuglink section: file name and CRC32.
+func debugLink(f *elf.File) (string, uint32, bool) {
+	s := f.Section(".gnu_debuglink")
+	if s == nil {
+		return "", 0, false
+	}
+	data, err := s.Data()
+	if err != nil {
+		return "", 0, false
+	}
+	end := bytes.IndexByte(data, 0)
+	if end <= 0 {
+		return "", 0, false
+	}
+	crcOffset := (end + 4) &^ 3
+	if crcOffset+4 > len(data) {
+		return "", 0, false
+	}
+	return string(data[:end]), f.ByteOrder.Uint32(data[crcOffset:]), true
+}
+
+func checkCRC(path string, crc uint32) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	return h.Sum32() == crc
+}
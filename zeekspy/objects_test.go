@@ -0,0 +1,90 @@
+package zeekspy
+
+import (
+	"debug/elf"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testLib = "testdata/dwarf/libzeek-layout.so.0"
+
+func TestObjectBias(t *testing.T) {
+	f, err := elf.Open(testLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, tc := range []struct {
+		start  uintptr
+		offset uint64
+		want   uintptr
+	}{
+		{0x7f0000000000, 0, 0x7f0000000000},
+		{0x7f0000001000, 0x1000, 0x7f0000000000}, // text mapped on its own
+	} {
+		bias, err := objectBias(f, tc.start, tc.offset)
+		if err != nil || bias != tc.want {
+			t.Errorf("objectBias(%#x, %#x) = %#x, %v, want %#x", tc.start, tc.offset, bias, err, tc.want)
+		}
+	}
+	if _, err := objectBias(f, 0x7f0000000000, 0x100000); err == nil {
+		t.Errorf("Expected error for offset past all segments")
+	}
+}
+
+func TestOpenDebugFileBuildID(t *testing.T) {
+	f, err := elf.Open(testLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buildID := elfBuildID(f)
+	if buildID == "" {
+		t.Fatalf("No build-id in %s", testLib)
+	}
+
+	dir := t.TempDir()
+	defer func(orig string) { debugFileDir = orig }(debugFileDir)
+	debugFileDir = dir
+
+	if path, d := openDebugFile("", testLib, f); d != nil {
+		t.Fatalf("Unexpected debug file %s", path)
+	}
+
+	data, err := ioutil.ReadFile(testLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, ".build-id", buildID[:2], buildID[2:]+".debug")
+	if err := os.MkdirAll(filepath.Dir(want), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(want, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path, d := openDebugFile("", testLib, f)
+	if d == nil || path != want {
+		t.Fatalf("Expected debug file %s, got %q", want, path)
+	}
+	d.Close()
+}
+
+func TestCheckCRC(t *testing.T) {
+	data, err := ioutil.ReadFile(testLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkCRC(testLib, crc32.ChecksumIEEE(data)) {
+		t.Errorf("CRC mismatch")
+	}
+	if checkCRC(testLib, crc32.ChecksumIEEE(data)+1) {
+		t.Errorf("Expected CRC mismatch")
+	}
+	if checkCRC("testdata/missing", 0) {
+		t.Errorf("Expected missing file to fail")
+	}
+}
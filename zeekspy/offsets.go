@@ -1,14 +1,26 @@
 package zeekspy
 
-import (
-	"strings"
-)
-
+// Sizes and member offsets of the Zeek objects we read, in bytes.
 type StructOffsets struct {
 	LocationSize      int
 	LocationFilename  int
 	LocationFirstLine int
 	LocationLastLine  int
+
+	ObjLocation int // BroObj::location
+
+	FuncKind int
+	FuncName int
+
+	FrameNextStmt int // 0 if unknown
+
+	CallInfoSize int
+	CallInfoCall int
+	CallInfoFunc int
+
+	// StdLibGNU, StdLibGNUOldABI or StdLibLLVM, detected from the
+	// binary if empty.
+	StdLib string `json:",omitempty"`
 }
 
 var structOffsetsMap = map[string]*StructOffsets{
@@ -17,28 +29,34 @@ var structOffsetsMap = map[string]*StructOffsets{
 		LocationFilename:  8,
 		LocationFirstLine: 16,
 		LocationLastLine:  20,
+		ObjLocation:       8,
+		FuncKind:          56,
+		FuncName:          72,
+		FrameNextStmt:     144,
+		CallInfoSize:      24,
+		CallInfoCall:      0,
+		CallInfoFunc:      8,
 	},
 	"3.1": &StructOffsets{
 		LocationSize:      16,
 		LocationFilename:  0,
 		LocationFirstLine: 8,
 		LocationLastLine:  12,
+		ObjLocation:       8,
+		FuncKind:          56,
+		FuncName:          72,
+		FrameNextStmt:     144,
+		CallInfoSize:      24,
+		CallInfoCall:      0,
+		CallInfoFunc:      8,
 	},
 }
 
-func getStructOffsets(version string) (*StructOffsets, bool) {
-	match := 0
-	use := ""
-	for k := range structOffsetsMap {
-		if !strings.HasPrefix(version, k) {
-			continue
-		}
-		if m := len(version) - len(strings.TrimPrefix(version, k)); m > match {
-			use = k
-		}
-	}
-	if use == "" {
-		return nil, false
-	}
-	return structOffsetsMap[use], true
+// The built-in offsets were determined for x86_64, the Zeek 3 ones with
+// GCC 8.3.0.
+const builtinArch = "x86_64"
+
+var structOffsetsCompilers = map[string]string{
+	"3.0": "GCC",
+	"3.1": "GCC",
 }
@@ -5,9 +5,12 @@ import (
 )
 
 func TestNoEntry(t *testing.T) {
-	got, ok := getStructOffsets("1.0")
-	if got != nil || ok {
-		t.Errorf("Expected nil, got %v", got)
+	// Zeek 4 and later need debug info or a layout file.
+	for _, version := range []string{"1.0", "4.0.5", "6.0.0-dev"} {
+		got, _, err := matchLayout(&Fingerprint{Version: version}, layoutCandidates())
+		if got != nil || err == nil {
+			t.Errorf("Expected nil for %s, got %v", version, got)
+		}
 	}
 }
 
@@ -21,12 +24,12 @@ func TestVersions(t *testing.T) {
 
 	for k, v := range table {
 		t.Run(k, func(t *testing.T) {
-			offsets, ok := getStructOffsets(k)
-			if !ok {
-				t.Errorf("OK is false?\n")
+			match, _, err := matchLayout(&Fingerprint{Version: k}, layoutCandidates())
+			if err != nil {
+				t.Fatalf("matchLayout failed: %v", err)
 			}
-			if offsets != structOffsetsMap[v] {
-				t.Errorf("Expected %v entry, got %v", v, offsets)
+			if match.Version != v || match.Offsets != *structOffsetsMap[v] {
+				t.Errorf("Expected %v entry, got %v", v, match.Version)
 			}
 		})
 	}
@@ -0,0 +1,139 @@
+// Coalescing reads of a single sample
+//
+// Decoding a sample issues many small reads, often close to each other.
+// The pageCache fetches whole pages, runs of adjacent pages with a single
+// read, and serves subsequent reads from them. The cache is dropped
+// whenever the process is stopped or resumed, so data is never reused
+// across samples.
+package zeekspy
+
+import (
+	"io"
+	"syscall"
+)
+
+const pageSize = 4096
+
+type cachedPage struct {
+	addr uintptr
+	data []byte
+}
+
+// Only a handful of pages are touched per sample, a slice is faster than
+// a map here. Page buffers are reused across samples.
+type pageCache struct {
+	MemoryReader
+	pages []cachedPage
+}
+
+func newPageCache(r MemoryReader) *pageCache {
+	return &pageCache{MemoryReader: r}
+}
+
+func (c *pageCache) Stop() error {
+	c.reset()
+	return c.MemoryReader.Stop()
+}
+
+func (c *pageCache) Resume() {
+	c.MemoryReader.Resume()
+	c.reset()
+}
+
+func (c *pageCache) reset() {
+	c.pages = c.pages[:0]
+}
+
+func (c *pageCache) lookup(addr uintptr) []byte {
+	for _, p := range c.pages {
+		if p.addr == addr {
+			return p.data
+		}
+	}
+	return nil
+}
+
+func (c *pageCache) ReadMemory(addr uintptr, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	first := addr &^ (pageSize - 1)
+	last := (addr + uintptr(len(data)) - 1) &^ (pageSize - 1)
+
+	for page := first; page <= last; page += pageSize {
+		if c.lookup(page) != nil {
+			continue
+		}
+		// Fetch all adjacent missing pages at once.
+		end := page
+		for end < last && c.lookup(end+pageSize) == nil {
+			end += pageSize
+		}
+		if err := c.fetch(page, end); err != nil {
+			// Some of the pages are not readable as a whole,
+			// just try what was asked for.
+			return c.MemoryReader.ReadMemory(addr, data)
+		}
+		page = end
+	}
+
+	for off := 0; off < len(data); {
+		a := addr + uintptr(off)
+		off += copy(data[off:], c.lookup(a &^ (pageSize - 1))[a&(pageSize-1):])
+	}
+	return nil
+}
+
+// Read pages first to last (inclusive) into the cache.
+func (c *pageCache) fetch(first, last uintptr) error {
+	count := int((last-first)/pageSize) + 1
+	n := len(c.pages)
+	for i := 0; i < count; i++ {
+		if len(c.pages) < cap(c.pages) {
+			c.pages = c.pages[:len(c.pages)+1]
+		} else {
+			c.pages = append(c.pages, cachedPage{})
+		}
+		p := &c.pages[n+i]
+		if p.data == nil {
+			p.data = make([]byte, pageSize)
+		}
+		p.addr = first + uintptr(i*pageSize)
+	}
+
+	if count == 1 {
+		if err := c.MemoryReader.ReadMemory(first, c.pages[n].data); err != nil {
+			c.pages = c.pages[:n]
+			return err
+		}
+		return nil
+	}
+
+	buf := make([]byte, count*pageSize)
+	if err := c.MemoryReader.ReadMemory(first, buf); err != nil {
+		c.pages = c.pages[:n]
+		return err
+	}
+	for i := 0; i < count; i++ {
+		copy(c.pages[n+i].data, buf[i*pageSize:])
+	}
+	return nil
+}
+
+func (c *pageCache) Syscalls() uint64 {
+	return countSyscalls(c.MemoryReader)
+}
+
+func (c *pageCache) exitStatus() (syscall.WaitStatus, bool) {
+	if r, ok := c.MemoryReader.(exitRecorder); ok {
+		return r.exitStatus()
+	}
+	return 0, false
+}
+
+func (c *pageCache) Close() error {
+	if closer, ok := c.MemoryReader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package zeekspy
+
+import (
+	"bytes"
+	"testing"
+)
+
+type countingMemory struct {
+	fakeMemory
+	reads int
+}
+
+func (m *countingMemory) ReadMemory(addr uintptr, data []byte) error {
+	m.reads++
+	return m.fakeMemory.ReadMemory(addr, data)
+}
+
+func newCountingMemory() *countingMemory {
+	m := &countingMemory{fakeMemory: fakeMemory{regions: make(map[uintptr][]byte)}}
+	mapped := make([]byte, 4*pageSize)
+	for i := range mapped {
+		mapped[i] = byte(i / 7)
+	}
+	m.put(0x10000, mapped)
+	return m
+}
+
+func TestPageCacheCoalesces(t *testing.T) {
+	m := newCountingMemory()
+	c := newPageCache(m)
+	c.Stop()
+
+	// Spanning two pages, then reads within those pages.
+	for _, r := range []struct{ addr, size uintptr }{
+		{0x10ff0, 0x20}, {0x10000, 8}, {0x11800, 16}, {0x10ff8, 8},
+	} {
+		got := make([]byte, r.size)
+		if err := c.ReadMemory(r.addr, got); err != nil {
+			t.Fatalf("ReadMemory(%#x) failed: %v", r.addr, err)
+		}
+		want := m.regions[0x10000][r.addr-0x10000 : r.addr-0x10000+r.size]
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadMemory(%#x) got %v, want %v", r.addr, got, want)
+		}
+	}
+	if m.reads != 1 {
+		t.Errorf("Expected a single read of both pages, got %d", m.reads)
+	}
+
+	// Nothing is reused after resuming.
+	c.Resume()
+	c.Stop()
+	c.ReadMemory(0x10000, make([]byte, 8))
+	if m.reads != 2 {
+		t.Errorf("Expected cache to be dropped, got %d reads", m.reads)
+	}
+}
+
+func TestPageCacheFallback(t *testing.T) {
+	m := newCountingMemory()
+	// Not page aligned and not a full page, fetching the page fails.
+	m.put(0x20010, []byte("zeek"))
+	c := newPageCache(m)
+
+	got := make([]byte, 4)
+	if err := c.ReadMemory(0x20010, got); err != nil || string(got) != "zeek" {
+		t.Errorf("Expected fallback read, got %q (%v)", got, err)
+	}
+	if err := c.ReadMemory(0x30000, got); err == nil {
+		t.Errorf("Expected error reading unmapped memory")
+	}
+}
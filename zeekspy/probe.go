@@ -0,0 +1,384 @@
+// Probing struct offsets of builds without debug info
+//
+// For a stripped Zeek binary without a matching layout, offsets are
+// guessed by looking at live objects reachable from call_stack: every
+// candidate offset is scored by how plausible the values found there
+// are, e.g. names that look like identifiers or filenames of existing
+// scripts. Func, CallExpr and Stmt objects live as long as the script
+// code, so their pointers are collected over many samples and only
+// looked at once at the end. Frames do not, so the start of the top
+// most Frame is copied for every sample.
+//
+// CallInfo has not changed since Zeek 3 and std::vector is decoded
+// according to the standard library, neither is probed.
+package zeekspy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Largest offset of Func::name, BroObj::location and
+	// Frame::next_stmt considered.
+	probeMaxOffset = 256
+	probeFrameSize = 512
+)
+
+// CallInfo is not probed, it has been {call, func, args} since Zeek 3.
+var probeCallInfo = &StructOffsets{CallInfoSize: 24, CallInfoCall: 0, CallInfoFunc: 8}
+
+// Copied start of the top most Frame of a sample.
+type probeFrame struct {
+	fn    uintptr // Func of the top most call
+	words []uintptr
+}
+
+type ProbeResult struct {
+	Offsets StructOffsets
+
+	// Samples taken and how many of them had a non-empty call_stack.
+	Samples  int
+	NonEmpty int
+
+	// How each offset was chosen, for review.
+	Notes []string
+}
+
+type prober struct {
+	zp     *ZeekProcess
+	exists func(filename string) bool
+
+	funcs  []uintptr
+	objs   []uintptr // Funcs and CallExprs, anything with a location
+	frames []probeFrame
+	seen   map[uintptr]bool // Whether an object is a Func
+}
+
+func (p *prober) addObj(addr uintptr, isFunc bool) {
+	if _, ok := p.seen[addr]; ok || addr == 0 {
+		return
+	}
+	p.seen[addr] = isFunc
+	if isFunc {
+		p.funcs = append(p.funcs, addr)
+	}
+	p.objs = append(p.objs, addr)
+}
+
+func (p *prober) ptr(addr uintptr) (uintptr, bool) {
+	data := make([]byte, 8)
+	if err := p.zp.read("probe", addr, data); err != nil {
+		return 0, false
+	}
+	ptr := uintptr(binary.LittleEndian.Uint64(data))
+	return ptr, p.validPtr(ptr)
+}
+
+func (p *prober) int32At(addr uintptr) (int32, bool) {
+	data := make([]byte, 4)
+	if err := p.zp.read("probe", addr, data); err != nil {
+		return 0, false
+	}
+	return int32(binary.LittleEndian.Uint32(data)), true
+}
+
+func (p *prober) stdString(addr uintptr) (string, bool) {
+	data := make([]byte, p.zp.stdlib.stringSize())
+	if err := p.zp.read("probe", addr, data); err != nil {
+		return "", false
+	}
+	s, err := p.zp.stdlib.decodeString(p.zp, addr, data)
+	return s, err == nil
+}
+
+// 1 for a script filename, 2 if it also exists.
+func (p *prober) scoreFilename(ptr uintptr) (string, int) {
+	name, err := p.zp.readNullTerminatedStr(ptr)
+	if err != nil || !printable(name) || !isScript(name) {
+		return "", 0
+	}
+	if p.exists != nil && p.exists(name) {
+		return name, 2
+	}
+	return name, 1
+}
+
+// Pick the offset with the highest score, the lowest one on ties.
+func bestOffset(scores map[int]int) (int, int) {
+	best, bestScore := 0, 0
+	for off, score := range scores {
+		if score > bestScore || (score == bestScore && score > 0 && off < best) {
+			best, bestScore = off, score
+		}
+	}
+	return best, bestScore
+}
+
+// Take up to samples samples and guess the struct offsets from the
+// objects found.
+func (zp *ZeekProcess) ProbeOffsets(samples int) (*ProbeResult, error) {
+	p := &prober{zp: zp, seen: make(map[uintptr]bool)}
+	if zp.Pid != 0 {
+		root, cwd := procPath(zp.Pid, "root"), procPath(zp.Pid, "cwd")
+		p.exists = func(filename string) bool {
+			if !filepath.IsAbs(filename) {
+				filename = filepath.Join(cwd, filename)
+			} else {
+				filename = filepath.Join(root, filename)
+			}
+			_, err := os.Stat(filename)
+			return err == nil
+		}
+	}
+
+	result := &ProbeResult{}
+	for result.Samples < samples {
+		result.Samples++
+		nonEmpty, err := p.collect()
+		if err != nil {
+			return nil, err
+		}
+		if nonEmpty {
+			result.NonEmpty++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(p.funcs) == 0 {
+		return nil, fmt.Errorf("call_stack empty in %d samples, is Zeek running scripts?", samples)
+	}
+
+	if err := zp.mem.Stop(); err != nil {
+		return nil, err
+	}
+	defer zp.mem.Resume()
+	if err := p.guess(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Collect the objects of a single sample, returns false if call_stack
+// was empty.
+func (p *prober) collect() (bool, error) {
+	zp := p.zp
+	if zp.regions != nil {
+		zp.regions.expire()
+	}
+	if err := zp.mem.Stop(); err != nil {
+		return false, err
+	}
+	defer zp.mem.Resume()
+
+	base := probeCallInfo
+	callVec, err := zp.readVectorSnapshot(zp.CallStackAddr, base.CallInfoSize)
+	if err != nil {
+		return false, err
+	}
+	frameVec, err := zp.readVectorSnapshot(zp.FrameStackAddr, 8)
+	if err != nil {
+		return false, err
+	}
+	n := callVec.len()
+	if n == 0 {
+		return false, nil
+	}
+
+	for i := 0; i < n; i++ {
+		data := callVec.data[i*base.CallInfoSize:]
+		p.addObj(uintptr(binary.LittleEndian.Uint64(data[base.CallInfoFunc:])), true)
+		p.addObj(uintptr(binary.LittleEndian.Uint64(data[base.CallInfoCall:])), false)
+	}
+
+	// Only if the top most frame belongs to the top most call.
+	if frameVec.len() < n {
+		return true, nil
+	}
+	framePtr := uintptr(binary.LittleEndian.Uint64(frameVec.data[len(frameVec.data)-8:]))
+	size := probeFrameSize
+	for zp.regions != nil && size > 0 && !zp.regions.covers(framePtr, size) {
+		size -= 8
+	}
+	data := make([]byte, size)
+	if size == 0 || zp.read("Frame", framePtr, data) != nil {
+		return true, nil
+	}
+	frame := probeFrame{fn: uintptr(binary.LittleEndian.Uint64(callVec.data[(n-1)*base.CallInfoSize+base.CallInfoFunc:]))}
+	for i := 0; i < size; i += 8 {
+		frame.words = append(frame.words, uintptr(binary.LittleEndian.Uint64(data[i:])))
+	}
+	p.frames = append(p.frames, frame)
+	return true, nil
+}
+
+func (p *prober) guess(result *ProbeResult) error {
+	o := &result.Offsets
+	base := probeCallInfo
+	o.CallInfoSize, o.CallInfoCall, o.CallInfoFunc = base.CallInfoSize, base.CallInfoCall, base.CallInfoFunc
+	o.StdLib = p.zp.StdLib()
+	note := func(format string, args ...interface{}) {
+		result.Notes = append(result.Notes, fmt.Sprintf(format, args...))
+	}
+
+	// Func::name: a std::string holding an identifier.
+	scores := make(map[int]int)
+	for off := 8; off <= probeMaxOffset; off += 8 {
+		for _, f := range p.funcs {
+			if s, ok := p.stdString(f + uintptr(off)); ok && funcNameRegexp.MatchString(s) {
+				scores[off]++
+			}
+		}
+	}
+	score := 0
+	if o.FuncName, score = bestOffset(scores); score == 0 {
+		return fmt.Errorf("No Func::name candidate for %d functions", len(p.funcs))
+	}
+	note("Func::name at %d: identifier in %d of %d functions", o.FuncName, score, len(p.funcs))
+
+	// BroObj::location and Location::filename: a pointer to a pointer
+	// to a script filename. Location may start with a vtable.
+	scores = make(map[int]int)
+	for objOff := 8; objOff <= 32; objOff += 8 {
+		for _, filenameOff := range []int{0, 8} {
+			for _, obj := range p.objs {
+				loc, ok := p.ptr(obj + uintptr(objOff))
+				if !ok {
+					continue
+				}
+				if name, ok := p.ptr(loc + uintptr(filenameOff)); ok {
+					_, s := p.scoreFilename(name)
+					scores[objOff*16+filenameOff] += s
+				}
+			}
+		}
+	}
+	best, score := bestOffset(scores)
+	if score == 0 {
+		return fmt.Errorf("No BroObj::location candidate for %d objects", len(p.objs))
+	}
+	o.ObjLocation, o.LocationFilename = best/16, best%16
+	note("BroObj::location at %d, Location::filename at %d: score %d for %d objects",
+		o.ObjLocation, o.LocationFilename, score, len(p.objs))
+
+	// Location::first_line and last_line: two int32 in ascending order.
+	scores = make(map[int]int)
+	for off := o.LocationFilename + 8; off <= o.LocationFilename+24; off += 4 {
+		for _, obj := range p.objs {
+			if loc, ok := p.ptr(obj + uintptr(o.ObjLocation)); ok && p.plausibleLines(loc, off) {
+				scores[off]++
+			}
+		}
+	}
+	if o.LocationFirstLine, score = bestOffset(scores); score == 0 {
+		return fmt.Errorf("No Location::first_line candidate")
+	}
+	o.LocationLastLine = o.LocationFirstLine + 4
+	o.LocationSize = (o.LocationLastLine + 4 + 7) &^ 7
+	note("Location::first_line at %d, last_line at %d: plausible for %d objects",
+		o.LocationFirstLine, o.LocationLastLine, score)
+
+	// Func::kind: 0 or 1 for all functions. There are usually several
+	// such fields, Zeek had it 16 bytes before the name for ever.
+	var candidates []int
+	for off := 16; off+4 <= o.FuncName; off += 4 {
+		if off >= o.ObjLocation && off < o.ObjLocation+8 {
+			continue
+		}
+		valid := true
+		for _, f := range p.funcs {
+			if v, ok := p.int32At(f + uintptr(off)); !ok || (v != BRO_FUNC && v != BUILTIN_FUNC) {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			candidates = append(candidates, off)
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("No Func::kind candidate before Func::name at %d", o.FuncName)
+	}
+	o.FuncKind = candidates[0]
+	for _, off := range candidates {
+		if abs(off-(o.FuncName-16)) < abs(o.FuncKind-(o.FuncName-16)) {
+			o.FuncKind = off
+		}
+	}
+	note("Func::kind at %d, closest to Func::name - 16 of %d candidates %v", o.FuncKind, len(candidates), candidates)
+
+	p.guessNextStmt(result)
+	return nil
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func (p *prober) plausibleLines(loc uintptr, off int) bool {
+	first, ok1 := p.int32At(loc + uintptr(off))
+	last, ok2 := p.int32At(loc + uintptr(off+4))
+	return ok1 && ok2 && first > 0 && first <= last && last <= maxLine
+}
+
+// The location of the object at addr using the offsets found so far.
+func (p *prober) location(o *StructOffsets, addr uintptr) (string, int32, int32, bool) {
+	loc, ok := p.ptr(addr + uintptr(o.ObjLocation))
+	if !ok || !p.plausibleLines(loc, o.LocationFirstLine) {
+		return "", 0, 0, false
+	}
+	namePtr, ok := p.ptr(loc + uintptr(o.LocationFilename))
+	if !ok {
+		return "", 0, 0, false
+	}
+	name, s := p.scoreFilename(namePtr)
+	first, _ := p.int32At(loc + uintptr(o.LocationFirstLine))
+	last, _ := p.int32At(loc + uintptr(o.LocationLastLine))
+	return name, first, last, s > 0
+}
+
+// Frame::next_stmt: a Stmt with a location inside the function of the
+// frame. Its whole body and the Func itself span all of the function
+// and are not counted.
+func (p *prober) guessNextStmt(result *ProbeResult) {
+	o := &result.Offsets
+	scores := make(map[int]int)
+	for _, frame := range p.frames {
+		fnName, fnFirst, fnLast, ok := p.location(o, frame.fn)
+		if !ok {
+			continue
+		}
+		for i, word := range frame.words {
+			off := i * 8
+			if off == 0 || off > probeMaxOffset || p.seen[word] || !p.validPtr(word) {
+				continue
+			}
+			name, first, last, ok := p.location(o, word)
+			if !ok {
+				continue
+			}
+			scores[off]++
+			if name == fnName && first >= fnFirst && last <= fnLast && (first != fnFirst || last != fnLast) {
+				scores[off] += 2
+			}
+		}
+	}
+	off, score := bestOffset(scores)
+	if score == 0 {
+		result.Notes = append(result.Notes, fmt.Sprintf(
+			"Frame::next_stmt not found in %d frames, top most calls are reported at their function", len(p.frames)))
+		return
+	}
+	o.FrameNextStmt = off
+	result.Notes = append(result.Notes, fmt.Sprintf(
+		"Frame::next_stmt at %d: statement inside the function in %d frames (score %d)", off, len(p.frames), score))
+}
+
+func (p *prober) validPtr(ptr uintptr) bool {
+	return ptr != 0 && (p.zp.regions == nil || p.zp.regions.check(ptr, 8))
+}
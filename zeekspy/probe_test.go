@@ -0,0 +1,73 @@
+package zeekspy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestProbeOffsets(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.offsets = nil
+	zp.regions = m.regionTable()
+
+	result, err := zp.ProbeOffsets(2)
+	if err != nil {
+		t.Fatalf("ProbeOffsets failed: %v", err)
+	}
+	if result.Samples != 2 || result.NonEmpty != 2 {
+		t.Errorf("Unexpected samples %+v", result)
+	}
+	want := *structOffsetsMap["3.0"]
+	want.StdLib = StdLibGNU
+	if result.Offsets != want {
+		t.Errorf("Expected %+v, got %+v\n%v", want, result.Offsets, result.Notes)
+	}
+}
+
+func TestProbeOffsetsZeek4(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.offsets = nil
+	zp.regions = m.regionTable()
+
+	// Location without vtable and Frame::next_stmt elsewhere.
+	for addr, lines := range map[uintptr][2]uint32{0x6000: {10, 20}, 0x6100: {12, 14}} {
+		locData := make([]byte, 16)
+		binary.LittleEndian.PutUint64(locData[0:], 0x7100)
+		binary.LittleEndian.PutUint32(locData[8:], lines[0])
+		binary.LittleEndian.PutUint32(locData[12:], lines[1])
+		m.put(addr, locData)
+	}
+	frameData := make([]byte, 152)
+	binary.LittleEndian.PutUint64(frameData[96:], 0x8000)
+	m.put(0x5000, frameData)
+
+	result, err := zp.ProbeOffsets(1)
+	if err != nil {
+		t.Fatalf("ProbeOffsets failed: %v", err)
+	}
+	want := StructOffsets{
+		LocationSize:      16,
+		LocationFilename:  0,
+		LocationFirstLine: 8,
+		LocationLastLine:  12,
+		ObjLocation:       8,
+		FuncKind:          56,
+		FuncName:          72,
+		FrameNextStmt:     96,
+		CallInfoSize:      24,
+		CallInfoCall:      0,
+		CallInfoFunc:      8,
+		StdLib:            StdLibGNU,
+	}
+	if result.Offsets != want {
+		t.Errorf("Expected %+v, got %+v\n%v", want, result.Offsets, result.Notes)
+	}
+}
+
+func TestProbeOffsetsEmpty(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.putPtrs(0x1000, 0x2000, 0x2000, 0x2018)
+	if _, err := zp.ProbeOffsets(2); err == nil {
+		t.Errorf("Expected error for empty call_stack")
+	}
+}
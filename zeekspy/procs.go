@@ -0,0 +1,117 @@
+// Selecting processes by name or as descendants of others
+package zeekspy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PIDs of the processes whose name in /proc/<pid>/comm matches re, as
+// for pgrep(1), sorted. zeek-spy itself is never returned.
+func FindPidsByName(re *regexp.Regexp) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, err := ioutil.ReadFile(procPath(pid, "comm"))
+		if err == nil && re.MatchString(strings.TrimSpace(string(comm))) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// Fields of /proc/<pid>/stat, see proc(5).
+type procStat struct {
+	State byte
+	Ppid  int
+	Start uint64 // Clock ticks after boot
+}
+
+func processStat(pid int) (*procStat, error) {
+	data, err := ioutil.ReadFile(procPath(pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The name in parentheses may contain spaces and parentheses.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("Bad stat of %d", pid)
+	}
+	// Fields from the state, field 3 in proc(5).
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("Bad stat of %d", pid)
+	}
+	stat := &procStat{State: fields[0][0]}
+	if stat.Ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	if stat.Start, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// Whether the process exists and is not a zombie.
+func processAlive(pid int) bool {
+	stat, err := processStat(pid)
+	return err == nil && stat.State != 'Z' && stat.State != 'X'
+}
+
+// Identifies a process by its PID and start time, as PIDs may be
+// reused.
+type ProcessKey struct {
+	Pid   int
+	Start uint64
+}
+
+func ProcessKeyOf(pid int) (ProcessKey, error) {
+	stat, err := processStat(pid)
+	if err != nil {
+		return ProcessKey{}, err
+	}
+	return ProcessKey{pid, stat.Start}, nil
+}
+
+// PIDs of all descendants of the given processes, sorted.
+func FindDescendants(pids []int) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if stat, err := processStat(pid); err == nil {
+			children[stat.Ppid] = append(children[stat.Ppid], pid)
+		}
+	}
+
+	var descendants []int
+	queue := append([]int{}, pids...)
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		descendants = append(descendants, children[pid]...)
+		queue = append(queue, children[pid]...)
+	}
+	sort.Ints(descendants)
+	return descendants, nil
+}
@@ -0,0 +1,63 @@
+package zeekspy
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestFindPidsByName(t *testing.T) {
+	fakeProc(t, map[int][3]string{
+		1:   {"systemd\n", "", ""},
+		200: {"zeek\n", "", ""},
+		30:  {"zeek\n", "", ""},
+		31:  {"zeekctl\n", "", ""},
+	})
+
+	pids, err := FindPidsByName(regexp.MustCompile(`^zeek$`))
+	if err != nil || !reflect.DeepEqual(pids, []int{30, 200}) {
+		t.Errorf("Expected [30 200], got %v, %v", pids, err)
+	}
+	pids, err = FindPidsByName(regexp.MustCompile(`zeek`))
+	if err != nil || !reflect.DeepEqual(pids, []int{30, 31, 200}) {
+		t.Errorf("Expected [30 31 200], got %v, %v", pids, err)
+	}
+	if pids, err := FindPidsByName(regexp.MustCompile(`^bro$`)); err != nil || len(pids) != 0 {
+		t.Errorf("Expected no matches, got %v, %v", pids, err)
+	}
+}
+
+// A /proc/<pid>/stat line with the given parent and start time.
+func fakeStat(pid, ppid int, name string, start uint64) string {
+	return fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 %d 2703360 335\n",
+		pid, name, ppid, pid, pid, start)
+}
+
+func TestFindDescendants(t *testing.T) {
+	fakeProc(t, map[int][3]string{
+		1:  {"systemd\n", "", ""},
+		10: {"zeek\n", "", ""},
+		11: {"zeek\n", "", ""},
+		12: {"zeek\n", "", ""},
+		13: {"zeek\n", "", ""},
+		20: {"sshd\n", "", ""},
+	})
+	for pid, ppid := range map[int]int{1: 0, 10: 1, 11: 10, 12: 11, 13: 10, 20: 1} {
+		writeProcFile(t, pid, "stat", fakeStat(pid, ppid, "zeek (stem) 1", 4711))
+	}
+
+	pids, err := FindDescendants([]int{10})
+	if err != nil || !reflect.DeepEqual(pids, []int{11, 12, 13}) {
+		t.Errorf("Expected [11 12 13], got %v, %v", pids, err)
+	}
+	if pids, _ := FindDescendants([]int{12}); len(pids) != 0 {
+		t.Errorf("Expected no descendants, got %v", pids)
+	}
+	if key, err := ProcessKeyOf(12); err != nil || key != (ProcessKey{12, 4711}) {
+		t.Errorf("Expected {12 4711}, got %v, %v", key, err)
+	}
+	if _, err := ProcessKeyOf(99); err == nil {
+		t.Errorf("Expected error for missing process")
+	}
+}
@@ -5,23 +5,47 @@ import (
 	"compress/gzip"
 	"io"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/awelzel/zeek-spy/perftools_profiles"
 	"github.com/golang/protobuf/proto"
 )
 
-type profileBuilder struct {
+// AddSample and WriteProfile may be called from multiple goroutines,
+// e.g. one per process sampled.
+type ProfileBuilder struct {
+	mu         sync.Mutex
 	nanos      int64
 	period     time.Duration
 	strings    []string
 	stringsMap map[string]int64
-	samples    [][]uint64
+	samples    []profileSample
 
 	locationsMap map[LocationKey]uint64
 	functionsMap map[FunctionKey]uint64
 }
 
+type profileSample struct {
+	locations []uint64
+	labels    []*perftools_profiles.Label
+}
+
+// String labels of a sample, e.g. the pid it was taken from. pprof
+// can filter and group by them with -tagfocus, -tagroot and others.
+type Labels map[string]string
+
+func (l Labels) String() string {
+	var s []string
+	for k, v := range l {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
 type FunctionKey struct {
 	FilenameId, NameId, Line int64
 }
@@ -31,8 +55,8 @@ type LocationKey struct {
 	Line   int
 }
 
-func NewProfileBuilder(period time.Duration) *profileBuilder {
-	b := profileBuilder{}
+func NewProfileBuilder(period time.Duration) *ProfileBuilder {
+	b := ProfileBuilder{}
 	b.nanos = time.Now().UnixNano()
 	b.period = period
 	b.stringsMap = make(map[string]int64)
@@ -47,7 +71,7 @@ func NewProfileBuilder(period time.Duration) *profileBuilder {
 }
 
 // Return the index of s in the string table
-func (b *profileBuilder) GetStringIndex(s string) int64 {
+func (b *ProfileBuilder) GetStringIndex(s string) int64 {
 	if i, ok := b.stringsMap[s]; ok {
 		return i
 	}
@@ -57,7 +81,7 @@ func (b *profileBuilder) GetStringIndex(s string) int64 {
 	return i
 }
 
-func (b *profileBuilder) GetFunctionId(filename, name string, line int) uint64 {
+func (b *ProfileBuilder) GetFunctionId(filename, name string, line int) uint64 {
 	key := FunctionKey{b.GetStringIndex(filename), b.GetStringIndex(name), int64(line)}
 
 	if i, ok := b.functionsMap[key]; ok {
@@ -69,7 +93,7 @@ func (b *profileBuilder) GetFunctionId(filename, name string, line int) uint64 {
 
 }
 
-func (b *profileBuilder) GetLocationId(funcId uint64, line int) uint64 {
+func (b *ProfileBuilder) GetLocationId(funcId uint64, line int) uint64 {
 
 	key := LocationKey{funcId, line}
 	if i, ok := b.locationsMap[key]; ok {
@@ -80,7 +104,14 @@ func (b *profileBuilder) GetLocationId(funcId uint64, line int) uint64 {
 	return i
 }
 
-func (b *profileBuilder) AddSample(stack []Call) {
+func (b *ProfileBuilder) AddSample(stack []Call) {
+	b.AddLabeledSample(stack, nil)
+}
+
+func (b *ProfileBuilder) AddLabeledSample(stack []Call, labels Labels) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	locations := make([]uint64, len(stack))
 	for i, c := range stack {
 		funcId := b.GetFunctionId(c.Func.Loc.Filename, c.Func.Name, c.Func.Loc.Start)
@@ -88,10 +119,29 @@ func (b *profileBuilder) AddSample(stack []Call) {
 		locId := b.GetLocationId(funcId, c.Line)
 		locations[i] = locId
 	}
-	b.samples = append(b.samples, locations)
+	b.samples = append(b.samples, profileSample{locations, b.getLabels(labels)})
 }
 
-func (b *profileBuilder) WriteProfile(w io.Writer) error {
+// Labels sorted by key for a stable output.
+func (b *ProfileBuilder) getLabels(labels Labels) []*perftools_profiles.Label {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*perftools_profiles.Label, len(keys))
+	for i, k := range keys {
+		result[i] = &perftools_profiles.Label{
+			Key: b.GetStringIndex(k),
+			Str: b.GetStringIndex(labels[k]),
+		}
+	}
+	return result
+}
+
+func (b *ProfileBuilder) WriteProfile(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	samplesValueType := perftools_profiles.ValueType{
 		Type: b.GetStringIndex("samples"),
@@ -103,7 +153,8 @@ func (b *profileBuilder) WriteProfile(w io.Writer) error {
 	}
 
 	samples := make([]*perftools_profiles.Sample, len(b.samples))
-	for i, locationIds := range b.samples {
+	for i, sample := range b.samples {
+		locationIds := sample.locations
 
 		// Reverse locations (https://github.com/golang/go/wiki/SliceTricks#reversing)
 		for j := len(locationIds)/2 - 1; j >= 0; j-- {
@@ -114,6 +165,7 @@ func (b *profileBuilder) WriteProfile(w io.Writer) error {
 		samples[i] = new(perftools_profiles.Sample)
 		samples[i].LocationId = locationIds
 		samples[i].Value = []int64{1, int64(b.period)}
+		samples[i].Label = sample.labels
 	}
 
 	functions := make([]*perftools_profiles.Function, len(b.functionsMap))
@@ -159,8 +211,9 @@ func (b *profileBuilder) WriteProfile(w io.Writer) error {
 	}
 
 	zw := gzip.NewWriter(w)
-	defer zw.Close()
-	zw.Write(data)
-
-	return nil
+	if _, err := zw.Write(data); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
 }
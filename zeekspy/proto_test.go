@@ -1,8 +1,15 @@
 package zeekspy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
 	"testing"
 	"time"
+
+	"github.com/awelzel/zeek-spy/perftools_profiles"
+	"github.com/golang/protobuf/proto"
 )
 
 func TestAddSample(t *testing.T) {
@@ -41,3 +48,59 @@ func TestGetStringIndex(t *testing.T) {
 		}
 	})
 }
+
+func TestAddLabeledSample(t *testing.T) {
+	b := NewProfileBuilder(time.Duration(1))
+	f := Func{123, "dns_message", 0, Location{"dns.bif", 442, 450}}
+	stack := []Call{{&f, "test/data.zeek", 42}}
+
+	b.AddLabeledSample(stack, Labels{"pid": "4711", "node": "sensor-1"})
+	b.AddSample(stack)
+
+	var buf bytes.Buffer
+	if err := b.WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p perftools_profiles.Profile
+	if err := proto.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Sample) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(p.Sample))
+	}
+	var labels []string
+	for _, l := range p.Sample[0].Label {
+		labels = append(labels, p.StringTable[l.Key]+"="+p.StringTable[l.Str])
+	}
+	if len(labels) != 2 || labels[0] != "node=sensor-1" || labels[1] != "pid=4711" {
+		t.Errorf("Expected [node=sensor-1 pid=4711], got %v", labels)
+	}
+	if len(p.Sample[1].Label) != 0 {
+		t.Errorf("Expected no labels, got %v", p.Sample[1].Label)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteProfileError(t *testing.T) {
+	b := NewProfileBuilder(time.Duration(1))
+	f := Func{123, "dns_message", 0, Location{"dns.bif", 442, 450}}
+	b.AddSample([]Call{{&f, "test/data.zeek", 42}})
+
+	if err := b.WriteProfile(failingWriter{}); err == nil {
+		t.Errorf("Expected error from writer")
+	}
+}
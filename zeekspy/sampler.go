@@ -0,0 +1,372 @@
+// Sampling a Zeek process periodically
+//
+// ptrace(2) requests must come from the thread that attached. A Sampler
+// attaches to its process from a dedicated goroutine locked to its OS
+// thread, and everything touching the process runs on that goroutine.
+// The thread exits when the Sampler is closed.
+//
+// If the reader does not stop the process, samples only capture raw
+// pointers and their names are resolved by another goroutine, see
+// resolver. Sampling does not wait for reading names then.
+package zeekspy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A sample delivered by a Sampler.
+type Sample struct {
+	Pid    int
+	Labels Labels
+	Time   time.Time
+	*SpyResult
+}
+
+type SamplerConfig struct {
+	Pid     int
+	Options Options
+	Period  time.Duration
+	Labels  Labels // Of every sample
+
+	// Sinks for samples, both optional and used from the sampler
+	// thread, or the resolving goroutine if the reader does not stop the
+	// process. Sending to Samples blocks sampling until received or the
+	// context is done.
+	OnSample func(*Sample)
+	Samples  chan<- *Sample
+
+	// Called every StatsInterval, if not 0.
+	StatsInterval time.Duration
+	OnStats       func(*SamplerStats)
+}
+
+type SamplerStats struct {
+	Pid          int
+	Elapsed      time.Duration
+	Samples      int
+	NonEmpty     int // Samples with a non-empty call stack
+	Inconsistent int // Samples where the call stack changed while reading
+	Retries      int
+	Skipped      int // Periods skipped because sampling took longer
+	Failed       int // Samples failed with a TransientError
+
+	// Since the previous stats.
+	Interval         time.Duration
+	IntervalSamples  int
+	IntervalSyscalls int
+	SamplingTime     time.Duration
+}
+
+// Samples per second since sampling started.
+func (st *SamplerStats) Frequency() float64 {
+	if st.Elapsed <= 0 {
+		return 0
+	}
+	return float64(st.Samples) / st.Elapsed.Seconds()
+}
+
+// Fraction of the interval spent sampling.
+func (st *SamplerStats) Overhead() float64 {
+	if st.Interval <= 0 {
+		return 0
+	}
+	return st.SamplingTime.Seconds() / st.Interval.Seconds()
+}
+
+func (st *SamplerStats) SyscallsPerSample() float64 {
+	if st.IntervalSamples == 0 {
+		return 0
+	}
+	return float64(st.IntervalSyscalls) / float64(st.IntervalSamples)
+}
+
+// Sampling fails after this many failed samples in a row.
+const maxFailedSamples = 100
+
+// Samples waiting for their names to be resolved before sampling blocks.
+const maxPendingSamples = 1000
+
+type Sampler struct {
+	config   SamplerConfig
+	process  *ZeekProcess
+	version  string
+	resolver *resolver // If the reader does not stop the process
+
+	resolveFailed int64 // Since the last stats, accessed atomically
+
+	// Functions to run on the sampler thread, until closed.
+	calls     chan func()
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	mu      sync.Mutex
+	closing bool
+	cancel  context.CancelFunc // Of the active Run
+}
+
+var errSamplerClosed = errors.New("Sampler is closed")
+
+// Attach to the process and read its version. Returns once attached,
+// the sampler thread is running until Close() then.
+func NewSampler(config SamplerConfig) (*Sampler, error) {
+	if config.Period <= 0 {
+		return nil, fmt.Errorf("Invalid sampling period %v", config.Period)
+	}
+	s := &Sampler{config: config, calls: make(chan func()), closed: make(chan struct{})}
+	errc := make(chan error)
+	go func() {
+		// Never unlocked, the thread exits with the goroutine.
+		runtime.LockOSThread()
+
+		zp, err := ZeekProcessFromPid(config.Pid, config.Options)
+		if err != nil {
+			errc <- err
+			return
+		}
+		// Read already if the offsets depend on it.
+		version := zp.version
+		if version == "" {
+			if version, err = zp.Version(); err != nil {
+				zp.Close()
+				errc <- classifyError(config.Pid, fmt.Errorf("Error reading version of pid=%d: %w", config.Pid, err))
+				return
+			}
+		}
+		if !zp.mem.Stopping() {
+			regions, err := newRegionTable(func() ([]MemoryRegion, error) { return readMaps(config.Pid) })
+			if err != nil {
+				zp.Close()
+				errc <- classifyError(config.Pid, fmt.Errorf("Could not read mappings of %d: %w", config.Pid, err))
+				return
+			}
+			s.resolver = newResolver(zp, &vmReadvReader{pid: config.Pid}, regions)
+		}
+		s.process, s.version = zp, version
+		errc <- nil
+		s.serve()
+	}()
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The process sampled. Its memory must only be read through the Sampler.
+func (s *Sampler) Process() *ZeekProcess {
+	return s.process
+}
+
+// The Zeek version read when attaching.
+func (s *Sampler) Version() string {
+	return s.version
+}
+
+// Run the functions passed to do() until closed.
+func (s *Sampler) serve() {
+	for {
+		select {
+		case f := <-s.calls:
+			f()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Run f on the sampler thread and wait for it. Fails once closed.
+func (s *Sampler) do(f func()) error {
+	done := make(chan struct{})
+	select {
+	case s.calls <- func() {
+		f()
+		close(done)
+	}:
+	case <-s.closed:
+		return errSamplerClosed
+	}
+	<-done
+	return nil
+}
+
+// Sample every period until ctx is done, then returns nil, or sampling
+// fails with an error that is not transient, e.g. because the process
+// exited. Transient errors result in failed samples, unless there are
+// maxFailedSamples of them in a row. Must not be called concurrently,
+// Close() stops it and it fails after.
+func (s *Sampler) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return errSamplerClosed
+	}
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	var err error
+	if cerr := s.do(func() { err = s.run(ctx) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Stop an active Run, detach from the process and end the sampler
+// thread. Calling it again returns the same error.
+func (s *Sampler) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+
+	s.closeOnce.Do(func() {
+		s.do(func() { s.closeErr = s.process.Close() })
+		close(s.closed)
+	})
+	return s.closeErr
+}
+
+// A sample waiting for its names to be resolved.
+type pendingSample struct {
+	sample *Sample
+	raw    *rawStack
+}
+
+func (s *Sampler) run(ctx context.Context) error {
+	zp := s.process
+	period := s.config.Period
+	stats := &SamplerStats{Pid: s.config.Pid}
+	totalStart := time.Now()
+	nextSample := totalStart
+	nextStats := totalStart.Add(s.config.StatsInterval)
+	statsStart := totalStart
+	failures := 0 // In a row
+
+	var pending chan pendingSample
+	resolveErr := make(chan error, 1)
+	if s.resolver != nil {
+		pending = make(chan pendingSample, maxPendingSamples)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.resolveSamples(ctx, pending, resolveErr)
+		}()
+		defer func() {
+			close(pending)
+			<-done
+		}()
+	}
+
+	for {
+		start := time.Now()
+		result, raw, err := zp.sample(s.resolver == nil)
+		if err != nil && !IsTransient(err) {
+			return err
+		} else if err != nil {
+			failures++
+			if failures >= maxFailedSamples {
+				return fmt.Errorf("%d samples failed in a row, last: %w", failures, err)
+			}
+			result = &SpyResult{Stack: failedCallStack, Failed: true}
+		} else {
+			failures = 0
+		}
+		diff := time.Since(start)
+		stats.Samples++
+		stats.IntervalSamples++
+		stats.IntervalSyscalls += result.Syscalls
+		stats.Retries += result.Retries
+		if result.Failed {
+			stats.Failed++
+		} else if result.Inconsistent {
+			stats.Inconsistent++
+		} else if !result.Empty {
+			stats.NonEmpty++
+		}
+
+		sample := &Sample{s.config.Pid, s.config.Labels, start, result}
+		if pending != nil && raw != nil {
+			select {
+			case pending <- pendingSample{sample, raw}:
+			case err := <-resolveErr:
+				return err
+			case <-ctx.Done():
+				return nil
+			}
+		} else if !s.deliver(ctx, sample) {
+			return nil
+		}
+
+		stats.SamplingTime += diff
+		skipped := int(diff / period)
+		stats.Skipped += skipped
+		nextSample = nextSample.Add(time.Duration(1+skipped) * period)
+
+		select {
+		case <-time.After(time.Until(nextSample)):
+		case err := <-resolveErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+
+		if now := time.Now(); s.config.StatsInterval > 0 && now.After(nextStats) {
+			stats.Failed += int(atomic.SwapInt64(&s.resolveFailed, 0))
+			stats.Elapsed = now.Sub(totalStart)
+			stats.Interval = now.Sub(statsStart)
+			if s.config.OnStats != nil {
+				s.config.OnStats(stats)
+			}
+			nextStats = nextStats.Add(s.config.StatsInterval)
+			statsStart = now
+			stats.SamplingTime = 0
+			stats.IntervalSamples = 0
+			stats.IntervalSyscalls = 0
+		}
+	}
+}
+
+// Pass sample to the sinks, returns false if ctx was done before.
+func (s *Sampler) deliver(ctx context.Context, sample *Sample) bool {
+	if s.config.OnSample != nil {
+		s.config.OnSample(sample)
+	}
+	if s.config.Samples != nil {
+		select {
+		case s.config.Samples <- sample:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve the names of pending samples and deliver them until pending
+// is closed. Samples whose names cannot be resolved are failed samples,
+// after maxFailedSamples of them in a row, an error is sent to errc.
+func (s *Sampler) resolveSamples(ctx context.Context, pending <-chan pendingSample, errc chan<- error) {
+	failures := 0 // In a row
+	for p := range pending {
+		stack, err := s.resolver.resolve(p.raw)
+		if err != nil {
+			atomic.AddInt64(&s.resolveFailed, 1)
+			if failures++; failures == maxFailedSamples {
+				errc <- fmt.Errorf("Names of %d samples in a row could not be resolved, last: %w", failures, err)
+			}
+			p.sample.Stack, p.sample.Failed = failedCallStack, true
+		} else {
+			failures = 0
+			p.sample.Stack = stack
+		}
+		s.deliver(ctx, p.sample)
+	}
+}
@@ -0,0 +1,186 @@
+package zeekspy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewSamplerInvalidPeriod(t *testing.T) {
+	if _, err := NewSampler(SamplerConfig{Pid: os.Getpid()}); err == nil {
+		t.Errorf("Expected error without period")
+	}
+}
+
+// The test binary has no Zeek symbols.
+func TestNewSamplerNotZeek(t *testing.T) {
+	_, err := NewSampler(SamplerConfig{Pid: os.Getpid(), Period: time.Millisecond})
+	if err == nil {
+		t.Errorf("Expected error for a process without Zeek")
+	}
+}
+
+// Start a process with Zeek's symbols but no debug info, traced by the
+// calling thread so that nobody else can attach to it.
+func startTracedZeek(t *testing.T) int {
+	lib, err := filepath.Abs("testdata/dwarf/libzeek-layout-stripped.so.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.StartProcess("/bin/sleep", []string{"sleep", "10"}, &os.ProcAttr{
+		Env: []string{"LD_PRELOAD=" + lib},
+		Sys: &syscall.SysProcAttr{Ptrace: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := proc.Pid
+	t.Cleanup(func() {
+		syscall.Kill(pid, syscall.SIGKILL)
+		proc.Wait()
+	})
+
+	// Stopped at execve(), continue until the library is loaded.
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.PtraceCont(pid, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !HasZeekSymbols(pid); i++ {
+		if i == 1000 {
+			t.Fatalf("No Zeek symbols in %d", pid)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return pid
+}
+
+// Reading the version needs to attach, which fails for a traced process.
+func TestNewSamplerTraced(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	pid := startTracedZeek(t)
+
+	_, err := NewSampler(SamplerConfig{Pid: pid, Period: time.Millisecond})
+	var perm *PermissionError
+	if !errors.As(err, &perm) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("Expected PermissionError, got %T %v", err, err)
+	}
+}
+
+// A Sampler of a fake process, without a locked thread.
+func newFakeSampler(config SamplerConfig) *Sampler {
+	zp, _ := newFakeZeek()
+	s := &Sampler{config: config, process: zp, calls: make(chan func()), closed: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func TestSamplerClose(t *testing.T) {
+	samples := 0
+	s := newFakeSampler(SamplerConfig{Period: time.Millisecond, OnSample: func(*Sample) { samples++ }})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Run(ctx); err != nil || samples == 0 {
+		t.Fatalf("Run failed: %v after %d samples", err, samples)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close %d failed: %v", i, err)
+		}
+	}
+	if err := s.Run(context.Background()); err != errSamplerClosed {
+		t.Errorf("Expected errSamplerClosed, got %v", err)
+	}
+}
+
+// Close stops an active Run instead of waiting for it.
+func TestSamplerCloseRunning(t *testing.T) {
+	s := newFakeSampler(SamplerConfig{Period: time.Millisecond})
+	errc := make(chan error)
+	go func() { errc <- s.Run(context.Background()) }()
+	time.Sleep(5 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close did not return")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Expected Run to return nil, got %v", err)
+	}
+}
+
+// Names of a process that is not stopped are resolved by the resolver,
+// reading through its own reader.
+func TestSamplerDeferred(t *testing.T) {
+	var samples []*Sample
+	s := newFakeSampler(SamplerConfig{Period: time.Millisecond, OnSample: func(sample *Sample) { samples = append(samples, sample) }})
+	m := s.process.mem.(*fakeMemory)
+	m.stopping = false
+	s.resolver = newResolver(s.process, m, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Run(ctx); err != nil || len(samples) == 0 {
+		t.Fatalf("Run failed: %v after %d samples", err, len(samples))
+	}
+	for _, sample := range samples {
+		if sample.Failed || len(sample.Stack) != 1 || sample.Stack[0].Func.Name != "zeek_init" {
+			t.Fatalf("Unexpected sample %+v", sample.SpyResult)
+		}
+	}
+}
+
+func TestSamplerDeferredFailed(t *testing.T) {
+	failed := 0
+	s := newFakeSampler(SamplerConfig{Period: time.Microsecond, OnSample: func(sample *Sample) {
+		if sample.Failed {
+			failed++
+		}
+	}})
+	s.process.mem.(*fakeMemory).stopping = false
+	s.resolver = newResolver(s.process, &fakeMemory{regions: make(map[uintptr][]byte)}, nil)
+
+	if err := s.Run(context.Background()); err == nil || failed < maxFailedSamples {
+		t.Errorf("Expected error after %d failed samples, got %v after %d", maxFailedSamples, err, failed)
+	}
+}
+
+func TestSamplerStats(t *testing.T) {
+	st := SamplerStats{
+		Elapsed:          2 * time.Second,
+		Samples:          200,
+		Interval:         time.Second,
+		IntervalSamples:  100,
+		IntervalSyscalls: 450,
+		SamplingTime:     250 * time.Millisecond,
+	}
+	if f := st.Frequency(); f != 100 {
+		t.Errorf("Expected 100hz, got %v", f)
+	}
+	if o := st.Overhead(); o != 0.25 {
+		t.Errorf("Expected 0.25, got %v", o)
+	}
+	if s := st.SyscallsPerSample(); s != 4.5 {
+		t.Errorf("Expected 4.5, got %v", s)
+	}
+
+	var empty SamplerStats
+	if empty.Frequency() != 0 || empty.Overhead() != 0 || empty.SyscallsPerSample() != 0 {
+		t.Errorf("Expected zeros for empty stats")
+	}
+}
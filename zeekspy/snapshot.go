@@ -0,0 +1,202 @@
+// Recording and replaying the memory read for a sample
+//
+// A Snapshot contains every memory range read while taking a sample,
+// the symbol addresses and the stack decoded at the time. Replaying a
+// snapshot allows testing the decoding logic without a live Zeek process.
+package zeekspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+type SnapshotRead struct {
+	Addr uint64
+	Data []byte
+}
+
+type Snapshot struct {
+	// Free form description, e.g. Zeek version and compiler.
+	Comment string `json:",omitempty"`
+
+	Version        string
+	Exe            string
+	LoadAddr       uint64
+	CallStackAddr  uint64
+	FrameStackAddr uint64
+	VersionAddr    uint64
+
+	// Offsets used when recording, if not the built-in ones.
+	Offsets *StructOffsets `json:",omitempty"`
+
+	// Standard library, StdLibGNU if empty.
+	StdLib string `json:",omitempty"`
+
+	// Compiler and architecture of the binary, if known.
+	Compiler string `json:",omitempty"`
+	Arch     string `json:",omitempty"`
+
+	// The stack as decoded when recording.
+	Stack []Call
+	Empty bool
+
+	Reads []SnapshotRead
+}
+
+// MemoryReader recording all successful reads of another reader.
+type recordingReader struct {
+	MemoryReader
+	reads []SnapshotRead
+}
+
+func (r *recordingReader) ReadMemory(addr uintptr, data []byte) error {
+	if err := r.MemoryReader.ReadMemory(addr, data); err != nil {
+		return err
+	}
+	r.reads = append(r.reads, SnapshotRead{uint64(addr), append([]byte(nil), data...)})
+	return nil
+}
+
+// MemoryReader serving reads from a Snapshot.
+type replayReader struct {
+	reads []SnapshotRead
+}
+
+func (r *replayReader) Stop() error {
+	return nil
+}
+
+func (r *replayReader) Resume() {
+}
+
+func (r *replayReader) Stopping() bool {
+	return true
+}
+
+// A read may be served from several recorded ones, e.g. a string that
+// was recorded in chunks.
+func (r *replayReader) ReadMemory(addr uintptr, data []byte) error {
+	for off := 0; off < len(data); {
+		next := uint64(addr) + uint64(off)
+		n := 0
+		for _, read := range r.reads {
+			if next >= read.Addr && next < read.Addr+uint64(len(read.Data)) {
+				n = copy(data[off:], read.Data[next-read.Addr:])
+				break
+			}
+		}
+		if n == 0 {
+			return fmt.Errorf("%#x+%d not in snapshot", addr, len(data))
+		}
+		off += n
+	}
+	return nil
+}
+
+// Take a single sample of zp and record all memory read for it. If
+// nonEmpty is set, samples with an empty call_stack are discarded
+// until attempts are exhausted. So are retried samples, as the reads of
+// their failed attempts would be replayed instead.
+func (zp *ZeekProcess) RecordSnapshot(nonEmpty bool, attempts int) (*Snapshot, error) {
+	rec := &recordingReader{MemoryReader: zp.mem}
+	zp.mem = rec
+	defer func() { zp.mem = rec.MemoryReader }()
+
+	var offsets *StructOffsets
+	if zp.OffsetsSource != "built-in" {
+		offsets = zp.offsets
+	}
+
+	for i := 0; ; i++ {
+		// Start with an empty cache so that all reads are recorded.
+		rec.reads = nil
+		zp.symbols = newSymbolCache()
+		version, err := zp.Version()
+		if err != nil {
+			return nil, err
+		}
+		result, err := zp.Spy()
+		if err != nil {
+			return nil, err
+		}
+		torn := result.Inconsistent || result.Retries > 0
+		if torn || (result.Empty && nonEmpty) {
+			if i+1 < attempts {
+				continue
+			}
+			if torn {
+				return nil, errTornRead
+			}
+		}
+		return &Snapshot{
+			Version:        version,
+			Exe:            zp.Exe,
+			LoadAddr:       uint64(zp.LoadAddr),
+			CallStackAddr:  uint64(zp.CallStackAddr),
+			FrameStackAddr: uint64(zp.FrameStackAddr),
+			VersionAddr:    uint64(zp.VersionAddr),
+			Offsets:        offsets,
+			StdLib:         zp.StdLib(),
+			Compiler:       zp.Compiler,
+			Arch:           zp.Arch,
+			Stack:          result.Stack,
+			Empty:          result.Empty,
+			Reads:          rec.reads,
+		}, nil
+	}
+}
+
+func (s *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var s Snapshot
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return nil, fmt.Errorf("Could not parse snapshot %s: %v", path, err)
+	}
+	return &s, nil
+}
+
+// Create a ZeekProcess that replays the memory of a snapshot.
+func ZeekProcessFromSnapshot(s *Snapshot) (*ZeekProcess, error) {
+	zp := &ZeekProcess{
+		Exe:            s.Exe,
+		mem:            &replayReader{s.Reads},
+		symbols:        newSymbolCache(),
+		LoadAddr:       uintptr(s.LoadAddr),
+		CallStackAddr:  uintptr(s.CallStackAddr),
+		FrameStackAddr: uintptr(s.FrameStackAddr),
+		VersionAddr:    uintptr(s.VersionAddr),
+		Compiler:       s.Compiler,
+		Arch:           s.Arch,
+	}
+	if s.Offsets != nil {
+		if err := s.Offsets.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid offsets in snapshot: %v", err)
+		}
+		zp.offsets = s.Offsets
+		zp.OffsetsSource = "snapshot"
+		zp.OffsetsReason = "recorded"
+	} else if err := zp.loadOffsets(nil); err != nil {
+		return nil, err
+	}
+	stdlib := s.StdLib
+	if stdlib == "" {
+		stdlib = StdLibGNU
+	}
+	if err := zp.setStdLib(stdlib); err != nil {
+		return nil, err
+	}
+	return zp, nil
+}
@@ -0,0 +1,102 @@
+package zeekspy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Replay every snapshot in testdata/snapshots and check that the stack
+// decodes to what was seen when recording it.
+func TestSnapshotFixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/snapshots/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No snapshots found")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			snapshot, err := ReadSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkReplay(t, snapshot)
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	zp, _ := newFakeZeek()
+	zp.VersionAddr = 0x9000
+	zp.mem.(*fakeMemory).put(0x9000, []byte("3.0.1\x00\x00\x00"))
+
+	snapshot, err := zp.RecordSnapshot(true, 1)
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	if snapshot.Version != "3.0.1" || len(snapshot.Reads) == 0 {
+		t.Fatalf("Unexpected snapshot %+v", snapshot)
+	}
+
+	var buf bytes.Buffer
+	if err := snapshot.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err = ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReplay(t, snapshot)
+}
+
+func checkReplay(t *testing.T, snapshot *Snapshot) {
+	zp, err := ZeekProcessFromSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if result.Empty != snapshot.Empty || !reflect.DeepEqual(result.Stack, snapshot.Stack) {
+		t.Errorf("Replayed stack differs\ngot:      %v\nexpected: %v", result.Stack, snapshot.Stack)
+	}
+}
+
+// Reads of a retried attempt would be replayed instead of the final ones.
+func TestSnapshotRetried(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.VersionAddr = 0x9000
+	m.put(0x9000, []byte("3.0.1\x00\x00\x00"))
+	m.stopping = false
+	funcData := m.regions[0x4000]
+	reads := 0
+	m.beforeRead = func(addr uintptr) {
+		if addr != zp.CallStackAddr {
+			return
+		}
+		if reads++; reads == 1 {
+			delete(m.regions, 0x4000)
+		} else {
+			m.put(0x4000, funcData)
+		}
+	}
+	if _, err := zp.RecordSnapshot(true, 1); err == nil {
+		t.Errorf("Expected error for a retried sample")
+	}
+
+	reads = 0
+	snapshot, err := zp.RecordSnapshot(true, 2)
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	checkReplay(t, snapshot)
+}
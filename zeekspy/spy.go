@@ -1,21 +1,14 @@
 // Spying on a zeek process
-//
-// TODO: make some effort to abstract GCC specifics (?)
-//
 package zeekspy
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math"
-	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"syscall"
 
 	"debug/elf"
@@ -24,7 +17,21 @@ import (
 type ZeekProcess struct {
 	Pid            int
 	Exe            string
+	Lib            string // libzeek.so with call_stack, if not in Exe
+	DebugFile      string // Separate debug file used, if any
+	BuildID        string
+	mem            MemoryReader
+	cache          *pageCache
+	regions        *regionTable
 	offsets        *StructOffsets
+	stdlib         stdLibrary
+	symbols        *symbolCache
+	live           bool   // Not a core file or snapshot, see classifyError()
+	version        string // If read for loadOffsets()
+	OffsetsSource  string // "debug info", "built-in", "layout file" or "snapshot"
+	OffsetsReason  string // What the offsets were chosen by
+	Compiler       string // From .comment, see elfCompiler()
+	Arch           string
 	LoadAddr       uintptr
 	CallStackAddr  uintptr
 	FrameStackAddr uintptr
@@ -32,13 +39,34 @@ type ZeekProcess struct {
 }
 
 func (zp *ZeekProcess) String() string {
+	exe := zp.Exe
+	if zp.Lib != "" {
+		exe += ", Lib=" + zp.Lib
+	}
+	if zp.DebugFile != "" {
+		exe += ", DebugFile=" + zp.DebugFile
+	}
 	return fmt.Sprintf("ZeekProcess{Pid=%d, Exe=%s, LoadAddr=%#x, CallStackAddr=%#x, FrameStackAddr=%#x VersionAddr=%#x}",
-		zp.Pid, zp.Exe, zp.LoadAddr, zp.CallStackAddr, zp.FrameStackAddr, zp.VersionAddr)
+		zp.Pid, exe, zp.LoadAddr, zp.CallStackAddr, zp.FrameStackAddr, zp.VersionAddr)
 }
 
 type SpyResult struct {
 	Stack []Call
 	Empty bool
+
+	// No consistent sample could be read from the running process
+	// and Stack is inconsistentCallStack.
+	Inconsistent bool
+
+	// Number of times the sample was retried.
+	Retries int
+
+	// Number of syscalls used for the sample, if known by the reader.
+	Syscalls int
+
+	// Sampling failed with a TransientError and Stack is
+	// failedCallStack. Only set by Sampler.
+	Failed bool
 }
 
 const (
@@ -71,175 +99,295 @@ func (f *Func) String() string {
 }
 
 var (
-	emptyCallStack = []Call{Call{&Func{0, "<empty_call_stack>", 1, Location{"<zeek>", 0, 0}}, "<zeek>", 0}}
-	nullLocation   = Location{"", 0, 0}
+	emptyCallStack        = []Call{Call{&Func{0, "<empty_call_stack>", 1, Location{"<zeek>", 0, 0}}, "<zeek>", 0}}
+	inconsistentCallStack = []Call{Call{&Func{0, "<inconsistent_sample>", 1, Location{"<zeek>", 0, 0}}, "<zeek>", 0}}
+	failedCallStack       = []Call{Call{&Func{0, "<failed_sample>", 1, Location{"<zeek>", 0, 0}}, "<zeek>", 0}}
+	nullLocation          = Location{"", 0, 0}
 )
 
-// Read all CallInfo entries stored in the call_stack vector.
-//
-// This assumes we have attached to the process, waited for it to stop
-// and that it is safe to call PtracePeekData.
+// Number of attempts to read a consistent sample when the reader does not
+// stop the process.
+const maxSampleAttempts = 3
+
+// Upper bound for the number of elements in call_stack or g_frame_stack.
+// Anything larger is the result of garbage pointers.
+const maxVectorLen = 100000
+
+var errTornRead = errors.New("call_stack or g_frame_stack changed while reading")
+
+// Read all CallInfo entries stored in the call_stack vector, and
+// resolve their names and locations if resolve is set.
 //
-// XXX: This is *very* GCC (8.3.0), Zeek (3.0.1) and arch (x86_64) specific!
-//      If we'd move the constants into a struct'ish thing, we migth be
-//      a bit more generic.
+// This assumes the process has been stopped via zp.mem.Stop() if
+// the reader requires it. If the reader does not stop the process,
+// call_stack and g_frame_stack may change while we are reading them.
+// In that case, both vectors are read again after decoding and a sample
+// that failed or saw them change is retried. After maxSampleAttempts,
+// errTornRead is returned if they changed during the last attempt, and
+// its error otherwise.
 //
-// XXX: If the interplay of of call_stack / g_frame_stack ever changes this
-//      will break left and right.
-func (zp *ZeekProcess) readCallStack() ([]Call, bool, error) {
+// Returns the raw stack, the resolved one, the number of retries and
+// an error, if any.
+func (zp *ZeekProcess) readCallStack(resolve bool) (*rawStack, []Call, int, error) {
+	var err error
+	for attempt := 1; attempt <= maxSampleAttempts; attempt++ {
+		var raw *rawStack
+		var stack []Call
+		raw, stack, err = zp.readCallStackOnce(resolve)
+		if err == nil || zp.mem.Stopping() {
+			return raw, stack, attempt - 1, err
+		}
+	}
+	return nil, nil, maxSampleAttempts - 1, err
+}
 
-	vecStart, vecFinish, vecData, err := zp.readStdVector(zp.CallStackAddr)
+func (zp *ZeekProcess) readCallStackOnce(resolve bool) (*rawStack, []Call, error) {
+	callVec, err := zp.readSampleVector(zp.CallStackAddr, zp.offsets.CallInfoSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	frameVec, err := zp.readSampleVector(zp.FrameStackAddr, 8)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
 
-	callStackSize := int(vecFinish-vecStart) / 24
-	if callStackSize == 0 {
-		return emptyCallStack, true, nil
+	raw, err := zp.captureCallStack(callVec, frameVec)
+	var stack []Call
+	if err == nil && resolve {
+		stack, err = zp.resolve(raw)
+	}
+	if zp.mem.Stopping() {
+		if resolve {
+			zp.symbols.settle(err == nil)
+		}
+		return raw, stack, err
+	}
+
+	// The process is running, check that nothing changed underneath.
+	// Errors are only blamed on that if something did.
+	changed, verr := zp.vectorsChanged(callVec, frameVec)
+	if resolve {
+		zp.symbols.settle(err == nil && verr == nil && !changed)
 	}
+	if verr != nil {
+		return nil, nil, verr
+	} else if changed && err != nil {
+		return nil, nil, fmt.Errorf("%w (%v)", errTornRead, err)
+	} else if changed {
+		return nil, nil, errTornRead
+	}
+	return raw, stack, err
+}
+
+// Resolve raw into Calls, emptyCallStack if there are none.
+func (zp *ZeekProcess) resolve(raw *rawStack) ([]Call, error) {
+	if len(raw.Calls) == 0 {
+		return emptyCallStack, nil
+	}
+	return zp.symbolize(raw)
+}
 
-	result := make([]Call, callStackSize)
+// Capture the Func pointers in callVec and the pointers of the objects
+// providing the current location of each call. Reading names and
+// locations is left to symbolize().
+//
+// XXX: Offsets come from zp.offsets, but this is still *very* GCC and
+//      arch (x86_64) specific!
+//
+// XXX: If the interplay of of call_stack / g_frame_stack ever changes this
+//      will break left and right.
+func (zp *ZeekProcess) captureCallStack(callVec, frameVec *vectorSnapshot) (*rawStack, error) {
+	vecData := callVec.data
+	callStackSize := callVec.len()
+	raw := &rawStack{Calls: make([]rawCall, callStackSize)}
+	if callStackSize == 0 {
+		return raw, nil
+	}
 
 	for i := 0; i < callStackSize; i++ {
-		offset := i * 24 // CallInfo is 3 pointers, 24 bytes
+		offset := i * zp.offsets.CallInfoSize
 
 		// log.Printf("data[%d]: %#x", i, data[offset:offset+24])
-		callPtr := uintptr(binary.LittleEndian.Uint64(vecData[offset : offset+8]))
+		callOffset := offset + zp.offsets.CallInfoCall
+		callPtr := uintptr(binary.LittleEndian.Uint64(vecData[callOffset : callOffset+8]))
 
-		// If there is a callPtr, update the previous Call instance
-		// to include the location information from it.
+		// If there is a callPtr, it has the location information
+		// for the previous call.
 		if callPtr > 0 && i > 0 {
-			loc, err := zp.readLocationFromBroObj(callPtr)
-			if err != nil {
-				return nil, false, err
-			}
-			result[i-1].Filename = loc.Filename
-			result[i-1].Line = loc.Start
+			raw.Calls[i-1].Obj = callPtr
 		}
 
-		funcPtr := uintptr(binary.LittleEndian.Uint64(vecData[offset+8 : offset+16]))
-		funcObj, err := zp.readFuncObject(funcPtr)
-		if err != nil {
-			return nil, false, err
-		}
-		result[i] = Call{funcObj, "", 0}
+		funcOffset := offset + zp.offsets.CallInfoFunc
+		funcPtr := uintptr(binary.LittleEndian.Uint64(vecData[funcOffset : funcOffset+8]))
+		raw.Calls[i].Func = funcPtr
 	}
 
 	// Find the approximate location of the current running code
 	// via the top most g_frame_stack Frame->next_stmt, but only
 	// if g_frame_stack and call_stack have the same size.
-	frameVecStart, frameVecFinish, frameVecData, err := zp.readStdVector(zp.FrameStackAddr)
-	if err != nil {
-		return nil, false, err
-	}
-	frameStackSize := int((frameVecFinish - frameVecStart) / 8)
-	if frameStackSize >= callStackSize {
+	frameVecData := frameVec.data
+	frameStackSize := frameVec.len()
+	if zp.offsets.FrameNextStmt == 0 {
+		raw.NoNextStmt = true
+	} else if frameStackSize >= callStackSize {
 
 		// Use the "right" frame if len(g_frame_stack) > len(call_stack)
 		framePtrOffset := len(frameVecData) - (frameStackSize-callStackSize+1)*8
 		framePtr := uintptr(binary.LittleEndian.Uint64(frameVecData[framePtrOffset : framePtrOffset+8]))
 
 		// Read the next_stmt pointer of the Frame and interpret it.
-		// It is at offset 144.
 		stmtData := make([]byte, 8)
-		_, err = syscall.PtracePeekData(zp.Pid, framePtr+144, stmtData)
+		err := zp.read("Frame", framePtr+uintptr(zp.offsets.FrameNextStmt), stmtData)
 		if err != nil {
-			return nil, false, err
-		}
-		stmtPtr := uintptr(binary.LittleEndian.Uint64(stmtData[:8]))
-
-		if stmtPtr > 0 {
-			loc, err := zp.readLocationFromBroObj(stmtPtr)
-			if err != nil {
-				return nil, false, err
-			}
-			result[callStackSize-1].Filename = loc.Filename
-			result[callStackSize-1].Line = loc.Start
+			return nil, err
 		}
+		raw.Calls[callStackSize-1].Obj = uintptr(binary.LittleEndian.Uint64(stmtData[:8]))
 	} else if callStackSize > frameStackSize {
-		f := result[callStackSize-1].Func
-		if f.Kind != BUILTIN_FUNC {
-			log.Printf("[WARN] call_stack larger, non built-in: %+v\n", f)
-		}
+		raw.NoFrame = true
 	}
 
-	//
-	// XXX: If the function at call_stack[0] is in a different file
-	//      than what was found via `call` or `Frame->next_stmt`, prepend
-	//      the original name/filename/line as a separate Call and "rewrite"
-	//      the original function to be more in line what the location
-	//      reported...
-	//
-	//      This is a limitations, as there's a single BroObj capturing
-	//      each event handler.
-	//
-	f0 := result[0].Func
-	if f0.Loc.Filename != result[0].Filename {
+	return raw, nil
+}
 
-		fakeFunc := *f0
+// A copy of a std::vector's header and elements. Used to detect whether
+// a vector changed while sampling a running process.
+type vectorSnapshot struct {
+	start, finish uintptr
+	elemSize      int
+	data          []byte
+}
 
-		// Update entry to at least point to the right filename
-		f0.Loc.Filename = result[0].Filename
-		f0.Loc.Start = 0 // We just don't know :-(
-		f0.Loc.End = 0
+func (v *vectorSnapshot) len() int {
+	return len(v.data) / v.elemSize
+}
+
+func (v *vectorSnapshot) equal(o *vectorSnapshot) bool {
+	return v.start == o.start && v.finish == o.finish && bytes.Equal(v.data, o.data)
+}
 
-		fakeCall := Call{&fakeFunc, fakeFunc.Loc.Filename, fakeFunc.Loc.Start}
-		result = append([]Call{fakeCall}, result...)
+func (zp *ZeekProcess) readVectorSnapshot(addr uintptr, elemSize int) (*vectorSnapshot, error) {
+	start, finish, data, err := zp.readStdVector(addr, elemSize)
+	if err != nil {
+		return nil, err
 	}
+	return &vectorSnapshot{start, finish, elemSize, data}, nil
+}
 
-	// for i, entry := range result {
-	//	log.Printf("result[%d]=%s:%d %+v\n", i, entry.Filename, entry.Line, entry.Func)
-	// }
+// Read call_stack or g_frame_stack for a sample. While the process is
+// running, a bad header may have been caught in the middle of an update,
+// so an error is only returned if reading the vector again fails, too.
+func (zp *ZeekProcess) readSampleVector(addr uintptr, elemSize int) (*vectorSnapshot, error) {
+	v, err := zp.readVectorSnapshot(addr, elemSize)
+	if err == nil || zp.mem.Stopping() {
+		return v, err
+	}
+	if zp.cache != nil {
+		zp.cache.reset()
+	}
+	if _, rerr := zp.readVectorSnapshot(addr, elemSize); rerr == nil {
+		return nil, fmt.Errorf("%w (%v)", errTornRead, err)
+	}
+	return nil, err
+}
 
-	return result, false, nil
+// Read call_stack and g_frame_stack again and compare with the
+// snapshots taken before decoding.
+func (zp *ZeekProcess) vectorsChanged(callVec, frameVec *vectorSnapshot) (bool, error) {
+	if zp.cache != nil {
+		zp.cache.reset()
+	}
+	for _, v := range []struct {
+		addr uintptr
+		snap *vectorSnapshot
+	}{{zp.CallStackAddr, callVec}, {zp.FrameStackAddr, frameVec}} {
+		again, err := zp.readVectorSnapshot(v.addr, v.snap.elemSize)
+		if err != nil {
+			return false, err
+		}
+		if !again.equal(v.snap) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (zp *ZeekProcess) readStdVector(addr uintptr) (uintptr, uintptr, []byte, error) {
+// Read a std::vector's header and all its elements of elemSize bytes.
+func (zp *ZeekProcess) readStdVector(addr uintptr, elemSize int) (uintptr, uintptr, []byte, error) {
 	data := make([]byte, 16)
-	_, err := syscall.PtracePeekData(zp.Pid, addr, data)
+	err := zp.read("std::vector", addr, data)
 	if err != nil {
 		return 0, 0, nil, err
 	}
-	start := uintptr(binary.LittleEndian.Uint64(data[:8]))
-	finish := uintptr(binary.LittleEndian.Uint64(data[8:16]))
+	startOffset, finishOffset := zp.stdlib.vectorBounds()
+	start := uintptr(binary.LittleEndian.Uint64(data[startOffset : startOffset+8]))
+	finish := uintptr(binary.LittleEndian.Uint64(data[finishOffset : finishOffset+8]))
+
+	// Do not trust a half-updated or garbage header.
+	size := int64(finish) - int64(start)
+	if size < 0 || size%int64(elemSize) != 0 || size/int64(elemSize) > maxVectorLen {
+		return 0, 0, nil, &LayoutMismatchError{"std::vector", addr,
+			fmt.Sprintf("bad header start=%#x finish=%#x", start, finish)}
+	}
 
 	data = make([]byte, finish-start)
-	count, err := syscall.PtracePeekData(zp.Pid, start, data)
-	if err != nil {
+	if err := zp.read("std::vector data", start, data); err != nil {
 		return 0, 0, nil, err
 	}
-	if count != int(finish-start) {
-		return 0, 0, nil, fmt.Errorf("Bad count %d", count)
-	}
 
 	return start, finish, data, nil
 }
 
 // Given a pointer to a Func object, extract name and location information.
-func (zp *ZeekProcess) readFuncObject(addr uintptr) (*Func, error) {
-
-	funcData := make([]byte, 96)
-	_, err := syscall.PtracePeekData(zp.Pid, addr, funcData)
-	if err != nil {
+// Read the part of a Func object that is decoded by decodeFunc().
+func (zp *ZeekProcess) readFuncData(addr uintptr) ([]byte, error) {
+	funcData := make([]byte, zp.funcDataSize())
+	if err := zp.read("Func", addr, funcData); err != nil {
 		return nil, err
 	}
-	kindValue := binary.LittleEndian.Uint64(funcData[56:64])
+	return funcData, nil
+}
+
+// Size of the part of a Func covering kind, name and location pointer.
+func (zp *ZeekProcess) funcDataSize() int {
+	o := zp.offsets
+	size := o.ObjLocation + 8
+	if o.FuncKind+4 > size {
+		size = o.FuncKind + 4
+	}
+	if o.FuncName+zp.stdlib.stringSize() > size {
+		size = o.FuncName + zp.stdlib.stringSize()
+	}
+	return size
+}
+
+// The fields of funcData a Func is decoded from: its kind, the name's
+// std::string and the location pointer. Unlike the reference count,
+// these do not change during the lifetime of a Func.
+func (zp *ZeekProcess) funcKey(funcData []byte) string {
+	o := zp.offsets
+	return string(funcData[o.FuncKind:o.FuncKind+4]) +
+		string(funcData[o.FuncName:o.FuncName+zp.stdlib.stringSize()]) +
+		string(funcData[o.ObjLocation:o.ObjLocation+8])
+}
+
+func (zp *ZeekProcess) decodeFunc(addr uintptr, funcData []byte) (*Func, error) {
+	o := zp.offsets
+	if len(funcData) < zp.funcDataSize() {
+		return nil, &LayoutMismatchError{"Func", addr, fmt.Sprintf("%d bytes of data", len(funcData))}
+	}
+	kindValue := binary.LittleEndian.Uint32(funcData[o.FuncKind : o.FuncKind+4])
 	kind := BRO_FUNC
 	if kindValue > 0 {
 		kind = BUILTIN_FUNC
 	}
 
-	// fmt.Printf("[DEBUG] Reading name at 72:80\n")
-	// std:string at offset 72
-	cStrPointer := uintptr(binary.LittleEndian.Uint64(funcData[72:80]))
-
-	funcName, err := zp.readNullTerminatedStr(cStrPointer)
+	nameData := funcData[o.FuncName : o.FuncName+zp.stdlib.stringSize()]
+	funcName, err := zp.stdlib.decodeString(zp, addr+uintptr(o.FuncName), nameData)
 	if err != nil {
 		return nil, err
 	}
 
-	// fmt.Printf("[DEBUG] Reading location at 8:16\n")
-	locPtr := uintptr(binary.LittleEndian.Uint64(funcData[8:16]))
+	locPtr := uintptr(binary.LittleEndian.Uint64(funcData[o.ObjLocation : o.ObjLocation+8]))
 	loc, err := zp.readLocation(locPtr)
 	if err != nil {
 		return nil, err
@@ -248,15 +396,13 @@ func (zp *ZeekProcess) readFuncObject(addr uintptr) (*Func, error) {
 }
 
 // A BroObj has its location pointer at offset 8, behind the vtable.
-func (zp *ZeekProcess) readLocationFromBroObj(addr uintptr) (*Location, error) {
-	data := make([]byte, 16) // vtable(8), locPtr(8)
-	_, err := syscall.PtracePeekData(zp.Pid, uintptr(addr), data)
+func (zp *ZeekProcess) readBroObjLocation(addr uintptr) (uintptr, error) {
+	data := make([]byte, 8)
+	err := zp.read("BroObj", addr+uintptr(zp.offsets.ObjLocation), data)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	locPtr := uintptr(binary.LittleEndian.Uint64(data[8:16]))
-	return zp.readLocation(locPtr)
-
+	return uintptr(binary.LittleEndian.Uint64(data)), nil
 }
 
 // addr must be a pointer to Location
@@ -271,7 +417,7 @@ func (zp *ZeekProcess) readLocation(addr uintptr) (*Location, error) {
 	}
 
 	locData := make([]byte, zp.offsets.LocationSize)
-	_, err := syscall.PtracePeekData(zp.Pid, addr, locData)
+	err := zp.read("Location", addr, locData)
 	if err != nil {
 		return nil, err
 	}
@@ -293,184 +439,332 @@ func (zp *ZeekProcess) readLocation(addr uintptr) (*Location, error) {
 	return &Location{filename, start, last}, nil
 }
 
+// Read 8 byte aligned chunks until a NULL byte is found. Staying aligned
+// ensures no read crosses into a page that might not be mapped. Gives up
+// after maxStringLen bytes.
 func (zp *ZeekProcess) readNullTerminatedStr(addr uintptr) (result string, err error) {
 	size := 8
-	data := make([]byte, size)
 	var buffer bytes.Buffer
-	for {
-		_, err := syscall.PtracePeekData(zp.Pid, addr, data)
-		if err != nil {
-			fmt.Printf("PtracePeekData error: %v\n", err)
+	for next := addr; buffer.Len() < maxStringLen; {
+		data := make([]byte, size-int(next%uintptr(size)))
+		if err := zp.read("string", next, data); err != nil {
 			return "", err
 		}
 
-		for _, b := range data {
-			if b == 0 {
-				goto done
-			}
-			buffer.WriteByte(b)
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			buffer.Write(data[:i])
+			return buffer.String(), nil
 		}
-		addr += uintptr(size)
+		buffer.Write(data)
+		next += uintptr(len(data))
 	}
-done:
-	// fmt.Printf("[DEBUG] Finished reading. got: %v\n", buffer.String())
-	return buffer.String(), nil
+	return "", &LayoutMismatchError{"string", addr, fmt.Sprintf("no NUL within %d bytes", maxStringLen)}
 }
 
-func (zp *ZeekProcess) attach() (err error) {
-	return syscall.PtraceAttach(zp.Pid)
+// Read remote memory after checking that addr points into a readable
+// mapping of the process.
+func (zp *ZeekProcess) read(what string, addr uintptr, data []byte) error {
+	if zp.regions != nil && !zp.regions.check(addr, len(data)) {
+		return &LayoutMismatchError{what, addr, "not in a readable mapping"}
+	}
+	return zp.mem.ReadMemory(addr, data)
 }
 
-func (zp *ZeekProcess) wait() (err error) {
-	var status syscall.WaitStatus
-	if _, err := syscall.Wait4(zp.Pid, &status, 0, nil); err != nil {
-		return err
-	}
-	if status.Exited() {
-		return errors.New("process exited")
-	}
-	if !status.Stopped() {
-		return errors.New("process did not stop")
+// Read the version from the process
+func (zp *ZeekProcess) Version() (string, error) {
+	if err := zp.mem.Stop(); err != nil {
+		return "", err
 	}
-	return err
+	defer zp.mem.Resume()
+
+	return zp.readNullTerminatedStr(zp.VersionAddr)
 }
 
-func (zp *ZeekProcess) detach() {
-	if err := syscall.PtraceDetach(zp.Pid); err != nil {
-		log.Printf("[WARN] Could not detach from process: %v\n", err)
+// Take a sample. Errors of live processes are one of those in errors.go,
+// those of core files and snapshots are returned as they are.
+func (zp *ZeekProcess) Spy() (*SpyResult, error) {
+	result, _, err := zp.sample(true)
+	return result, err
+}
+
+// Take a sample as Spy() does. Unless resolve is set, Stack is nil and
+// the raw stack is returned instead, except for inconsistent samples.
+func (zp *ZeekProcess) sample(resolve bool) (*SpyResult, *rawStack, error) {
+	before := countSyscalls(zp.mem)
+	result, raw, err := zp.spy(resolve)
+	if result != nil {
+		result.Syscalls = int(countSyscalls(zp.mem) - before)
+	}
+	if !zp.live {
+		return result, raw, err
 	}
+	return result, raw, classifyError(zp.Pid, err)
 }
 
-// Read the version from the process
-func (zp *ZeekProcess) Version() (string, error) {
-	if err := zp.attach(); err != nil {
-		return "", err
+func (zp *ZeekProcess) spy(resolve bool) (*SpyResult, *rawStack, error) {
+	if zp.regions != nil {
+		zp.regions.expire()
 	}
-	defer zp.detach()
+	if err := zp.mem.Stop(); err != nil {
+		return nil, nil, err
+	}
+	defer zp.mem.Resume()
 
-	if err := zp.wait(); err != nil {
-		log.Printf("[WARN] wait() failed for %d: %v\n", zp.Pid, err)
-		return "", err
+	raw, stack, retries, err := zp.readCallStack(resolve)
+	if errors.Is(err, errTornRead) {
+		return &SpyResult{inconsistentCallStack, false, true, retries, 0, false}, nil, nil
+	} else if err != nil {
+		return nil, nil, err
 	}
 
-	return zp.readNullTerminatedStr(zp.VersionAddr)
+	return &SpyResult{stack, len(raw.Calls) == 0, false, retries, 0, false}, raw, nil
 }
 
-func (zp *ZeekProcess) Spy() (*SpyResult, error) {
+// Options for attaching to a Zeek process.
+type Options struct {
+	// Memory reader to use, one of ReaderKinds. Defaults to ReaderPtrace.
+	Reader string
 
-	if err := zp.attach(); err != nil {
-		return nil, err
+	// Fetch whole pages and serve all reads of a sample from them.
+	PageCache bool
+
+	// Do not fail without struct offsets for the Zeek version. They
+	// need to be probed before sampling.
+	AnyVersion bool
+}
+
+// Parses /proc/{pid} data and uses elf to find the call_stack address.
+// Fails e.g. for a process that is not Zeek or has not loaded libzeek.so
+// yet, or with a PermissionError. The process is only attached to once
+// Zeek's symbols were found.
+func ZeekProcessFromPid(pid int, opts Options) (*ZeekProcess, error) {
+	exe, err := processExe(pid)
+	if err != nil {
+		return nil, classifyError(pid, fmt.Errorf("Could not readlink exe of %d: %w", pid, err))
+	}
+
+	regions, err := newRegionTable(func() ([]MemoryRegion, error) { return readMaps(pid) })
+	if err != nil {
+		return nil, classifyError(pid, fmt.Errorf("Could not read mappings of %d: %w", pid, err))
 	}
-	defer zp.detach()
 
-	if err := zp.wait(); err != nil {
-		log.Printf("[WARN] wait() failed for %d: %v\n", zp.Pid, err)
+	objects := processObjects(pid, exe, mappedObjects(regions.regions))
+	obj, err := findZeekObject(procPath(pid, "root"), exe, objects)
+	if err != nil {
 		return nil, err
 	}
+	defer obj.Close()
 
-	stack, empty, err := zp.readCallStack()
+	mem, err := newMemoryReader(opts.Reader, pid)
 	if err != nil {
+		return nil, fmt.Errorf("Could not create memory reader: %v", err)
+	}
+
+	var cache *pageCache
+	if opts.PageCache {
+		cache = newPageCache(mem)
+		mem = cache
+	}
+
+	zp := newZeekProcess(pid, exe, mem, obj)
+	zp.cache = cache
+	zp.regions = regions
+	zp.live = true
+	if err := zp.loadOffsets(obj.dwarfFile()); err != nil {
+		var (
+			exited *ProcessExitedError
+			perm   *PermissionError
+		)
+		if !opts.AnyVersion || errors.As(err, &exited) || errors.As(err, &perm) {
+			zp.Close()
+			return nil, err
+		}
+		log.Printf("[WARN] %v", err)
+	}
+	if err := zp.setStdLib(detectStdLib(obj.File)); err != nil {
+		zp.Close()
 		return nil, err
 	}
+	return zp, nil
+}
 
-	return &SpyResult{stack, empty}, nil
+// Addresses of the symbols we need, relative to the load address.
+type zeekSymbols struct {
+	CallStack  uint64
+	FrameStack uint64
+	Version    uint64
 }
 
-// Parses /proc/{pid} data and uses elf to find the call_stack address.
-func ZeekProcessFromPid(pid int) *ZeekProcess {
-	var f *elf.File
-	var err error
-	var exe string
-	var symbols []elf.Symbol
-	var callStackSym, frameStackSym, versionSym elf.Symbol
+// Symbol names, in order of preference. Zeek 4 moved call_stack and
+// g_frame_stack into the zeek::detail namespace, version is C.
+var (
+	callStackNames  = []string{"zeek::detail::call_stack", "call_stack"}
+	frameStackNames = []string{"zeek::detail::g_frame_stack", "g_frame_stack"}
+	versionNames    = []string{"version"}
+)
 
-	exeLink := fmt.Sprintf("/proc/%d/exe", pid)
-	if exe, err = os.Readlink(exeLink); err != nil {
-		log.Fatalf("Could not readlink %v: %v", exeLink, err)
+// Find call_stack, g_frame_stack and version in the dynamic symbols of
+// f, or its symbol table if not exported.
+func findZeekSymbols(f *elf.File) (*zeekSymbols, error) {
+	values := make(map[string]uint64)
+	collect := func(symbols []elf.Symbol) {
+		for _, symbol := range symbols {
+			if symbol.Value == 0 || elf.ST_TYPE(symbol.Info) != elf.STT_OBJECT ||
+				elf.ST_BIND(symbol.Info) == elf.STB_LOCAL {
+				continue
+			}
+			name := symbol.Name
+			if demangled, ok := demangle(name); ok {
+				name = demangled
+			}
+			if _, ok := values[name]; !ok {
+				values[name] = symbol.Value
+			}
+		}
 	}
 
-	if f, err = elf.Open(exe); err != nil {
-		log.Fatalf("Could not open %v: %v", exe, err)
+	dynamic, err := f.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("Could not fetch symbols: %v", err)
 	}
-
-	defer f.Close()
-
-	loadAddr, err := findLoadAddr(pid, exe)
-
-	if symbols, err = f.DynamicSymbols(); err != nil {
-		log.Fatalf("Could not fetch symbols from %v: %v", f, err)
+	collect(dynamic)
+	if static, err := f.Symbols(); err == nil {
+		collect(static)
 	}
-	for _, symbol := range symbols {
-		if symbol.Name == "call_stack" {
-			callStackSym = symbol
-		} else if symbol.Name == "g_frame_stack" {
-			frameStackSym = symbol
-		} else if symbol.Name == "version" {
-			versionSym = symbol
-		}
 
-		if callStackSym.Value != 0 && frameStackSym.Value != 0 && versionSym.Value != 0 {
-			break
+	lookup := func(names []string) uint64 {
+		for _, name := range names {
+			if value := values[name]; value != 0 {
+				return value
+			}
 		}
+		return 0
 	}
-	if callStackSym.Value == 0 {
-		log.Fatalf("Could not find call_stack symbol in %s", exe)
+	result := &zeekSymbols{lookup(callStackNames), lookup(frameStackNames), lookup(versionNames)}
+	if result.CallStack == 0 {
+		return nil, errors.New("Could not find call_stack symbol")
 	}
-	if frameStackSym.Value == 0 {
-		log.Fatalf("Could not find g_frame_stack symbol in %s", exe)
+	if result.FrameStack == 0 {
+		return nil, errors.New("Could not find g_frame_stack symbol")
 	}
-	if versionSym.Value == 0 {
-		log.Fatalf("Could not find version symbol in %s", exe)
+	if result.Version == 0 {
+		return nil, errors.New("Could not find version symbol")
 	}
+	return result, nil
+}
 
-	frameStackAddr := loadAddr + uintptr(frameStackSym.Value)
-	callStackAddr := loadAddr + uintptr(callStackSym.Value)
-	versionAddr := loadAddr + uintptr(versionSym.Value)
-
+func newZeekProcess(pid int, exe string, mem MemoryReader, obj *zeekObject) *ZeekProcess {
 	zp := &ZeekProcess{
 		Pid:            pid,
 		Exe:            exe,
+		BuildID:        elfBuildID(obj.File),
+		Compiler:       elfCompiler(obj.File),
+		Arch:           elfArch(obj.File),
+		DebugFile:      obj.DebugPath,
+		mem:            mem,
 		offsets:        nil,
-		LoadAddr:       loadAddr,
-		CallStackAddr:  callStackAddr,
-		FrameStackAddr: frameStackAddr,
-		VersionAddr:    versionAddr,
+		symbols:        newSymbolCache(),
+		LoadAddr:       obj.Bias,
+		CallStackAddr:  obj.Bias + uintptr(obj.Symbols.CallStack),
+		FrameStackAddr: obj.Bias + uintptr(obj.Symbols.FrameStack),
+		VersionAddr:    obj.Bias + uintptr(obj.Symbols.Version),
 	}
+	if obj.Path != exe {
+		zp.Lib = obj.Path
+	}
+	return zp
+}
+
+// Pick the StructOffsets, in order of preference from: a layout file
+// entry for the build-id, the debug info of f, a layout file entry for
+// the version, or the built-in ones for the version. f may be nil.
+func (zp *ZeekProcess) loadOffsets(f *elf.File) error {
+	if offsets := layoutForBuildID(zp.BuildID); offsets != nil {
+		zp.offsets = offsets
+		zp.OffsetsSource = "layout file (build-id)"
+		zp.OffsetsReason = "build-id " + zp.BuildID
+		return nil
+	}
+
+	if f != nil {
+		d, err := f.DWARF()
+		if err == nil {
+			var offsets *StructOffsets
+			if offsets, err = offsetsFromDwarf(d); err == nil {
+				zp.offsets = offsets
+				zp.OffsetsSource = "debug info"
+				zp.OffsetsReason = "from " + zp.debugInfoPath()
+				return nil
+			}
+		}
+		if f.Section(".debug_info") != nil {
+			log.Printf("[WARN] Could not use debug info of %s: %v", zp.Exe, err)
+		}
+	}
+
 	version, err := zp.Version()
 	if err != nil {
-		log.Fatalf("Could not determine version: %v\n", err)
+		err = fmt.Errorf("Could not determine version: %w", err)
+		if zp.live {
+			err = classifyError(zp.Pid, err)
+		}
+		return err
 	}
-	offsets, ok := getStructOffsets(version)
-	if !ok {
-		log.Fatalf("Could not find offsets for %v\n", version)
+	zp.version = version
+	fp := &Fingerprint{zp.BuildID, version, zp.Compiler, zp.Arch}
+	match, reason, err := matchLayout(fp, layoutCandidates())
+	if err != nil {
+		return err
 	}
-	zp.offsets = offsets
-	return zp
+	zp.offsets = &match.Offsets
+	zp.OffsetsSource = match.Source
+	zp.OffsetsReason = reason
+	return nil
 }
 
-// Parse /proc/<pid>/maps and return the lowest address for exeFilename
-func findLoadAddr(pid int, exeFilename string) (uintptr, error) {
-	var resultAddr uint64 = math.MaxUint64
+// Where debug info was read from.
+func (zp *ZeekProcess) debugInfoPath() string {
+	switch {
+	case zp.DebugFile != "":
+		return zp.DebugFile
+	case zp.Lib != "":
+		return zp.Lib
+	}
+	return zp.Exe
+}
 
-	maps := fmt.Sprintf("/proc/%d/maps", pid)
-	f, err := os.Open(maps)
+// Use the standard library of the offsets, or detected if unset.
+func (zp *ZeekProcess) setStdLib(detected string) error {
+	name := detected
+	if zp.offsets != nil && zp.offsets.StdLib != "" {
+		name = zp.offsets.StdLib
+	}
+	stdlib, err := stdLibraryByName(name)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.Contains(line, exeFilename) {
-			continue
-		}
-		fields := strings.Split(line, "-")
-		if addr, err := strconv.ParseUint(fields[0], 16, 64); err == nil {
-			// fmt.Printf("%s: %s 0:%v\n", maps, line, addr)
-			if addr < resultAddr {
-				resultAddr = addr
-			}
-		}
+	zp.stdlib = stdlib
+	return nil
+}
+
+// Name of the C++ standard library assumed for the process.
+func (zp *ZeekProcess) StdLib() string {
+	return zp.stdlib.Name()
+}
+
+// Wait status of the process if the reader reaped it after it exited.
+// This only happens for children of zeek-spy, see StartZeek.
+func (zp *ZeekProcess) ExitStatus() (syscall.WaitStatus, bool) {
+	if r, ok := zp.mem.(exitRecorder); ok {
+		return r.exitStatus()
+	}
+	return 0, false
+}
+
+// Release resources held by the memory reader, if any.
+func (zp *ZeekProcess) Close() error {
+	if c, ok := zp.mem.(io.Closer); ok {
+		return c.Close()
 	}
-	return uintptr(resultAddr), nil
+	return nil
 }
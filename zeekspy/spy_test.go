@@ -0,0 +1,455 @@
+package zeekspy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFindZeekObject(t *testing.T) {
+	// layout.o has none of the symbols, they are in the library.
+	objects := []mappedObject{
+		{Path: "/usr/lib/libc.so.6", Start: 0x7e0000000000},
+		{Path: "testdata/dwarf/libzeek-layout.so.0", Start: 0x7f0000000000},
+	}
+	obj, err := findZeekObject("", "testdata/dwarf/layout.o", objects)
+	if err != nil {
+		t.Fatalf("findZeekObject failed: %v", err)
+	}
+	defer obj.Close()
+	if obj.Path != objects[1].Path || obj.Bias != 0x7f0000000000 {
+		t.Errorf("Unexpected object %s with bias %#x", obj.Path, obj.Bias)
+	}
+	if s := obj.Symbols; s.CallStack != 0x4060 || s.FrameStack != 0x4080 || s.Version != 0x4038 {
+		t.Errorf("Unexpected symbols %+v", s)
+	}
+
+	if _, err := findZeekObject("", "testdata/dwarf/layout.o", nil); err == nil {
+		t.Errorf("Expected error without library")
+	}
+}
+
+// In-memory MemoryReader made of separate regions.
+type fakeMemory struct {
+	regions    map[uintptr][]byte
+	stopping   bool
+	beforeRead func(addr uintptr)
+}
+
+func (m *fakeMemory) Stop() error    { return nil }
+func (m *fakeMemory) Resume()        {}
+func (m *fakeMemory) Stopping() bool { return m.stopping }
+
+func (m *fakeMemory) ReadMemory(addr uintptr, data []byte) error {
+	if m.beforeRead != nil {
+		m.beforeRead(addr)
+	}
+	for start, region := range m.regions {
+		if addr >= start && addr+uintptr(len(data)) <= start+uintptr(len(region)) {
+			copy(data, region[addr-start:])
+			return nil
+		}
+	}
+	return fmt.Errorf("fake: %#x+%d not mapped", addr, len(data))
+}
+
+func (m *fakeMemory) put(addr uintptr, data []byte) {
+	m.regions[addr] = data
+}
+
+func (m *fakeMemory) putPtrs(addr uintptr, ptrs ...uintptr) {
+	data := make([]byte, 8*len(ptrs))
+	for i, p := range ptrs {
+		binary.LittleEndian.PutUint64(data[i*8:], uint64(p))
+	}
+	m.put(addr, data)
+}
+
+// Lay out memory as Zeek 3.0 would when executing zeek_init() and
+// return a ZeekProcess reading from it.
+func newFakeZeek() (*ZeekProcess, *fakeMemory) {
+	m := &fakeMemory{regions: make(map[uintptr][]byte), stopping: true}
+
+	m.putPtrs(0x1000, 0x2000, 0x2018, 0x2018) // call_stack
+	m.putPtrs(0x1100, 0x3000, 0x3008, 0x3008) // g_frame_stack
+	m.putPtrs(0x2000, 0, 0x4000, 0)           // CallInfo{call, func, args}
+	m.putPtrs(0x3000, 0x5000)                 // Frame*
+
+	funcData := make([]byte, 96)
+	binary.LittleEndian.PutUint64(funcData[8:], 0x6000)  // location
+	binary.LittleEndian.PutUint64(funcData[72:], 0x7000) // name
+	binary.LittleEndian.PutUint64(funcData[80:], 9)      // name length
+	m.put(0x4000, funcData)
+
+	frameData := make([]byte, 152)
+	binary.LittleEndian.PutUint64(frameData[144:], 0x8000) // next_stmt
+	m.put(0x5000, frameData)
+	m.putPtrs(0x8000, 0, 0x6100) // Stmt{vtable, location}
+
+	for addr, lines := range map[uintptr][2]uint32{0x6000: {10, 20}, 0x6100: {12, 12}} {
+		locData := make([]byte, 24)
+		binary.LittleEndian.PutUint64(locData[8:], 0x7100)
+		binary.LittleEndian.PutUint32(locData[16:], lines[0])
+		binary.LittleEndian.PutUint32(locData[20:], lines[1])
+		m.put(addr, locData)
+	}
+	m.put(0x7000, []byte("zeek_init\x00\x00\x00\x00\x00\x00\x00"))
+	m.put(0x7100, []byte("base/init.zeek\x00\x00"))
+
+	zp := &ZeekProcess{
+		mem:            m,
+		offsets:        structOffsetsMap["3.0"],
+		stdlib:         libstdcxx{},
+		symbols:        newSymbolCache(),
+		CallStackAddr:  0x1000,
+		FrameStackAddr: 0x1100,
+	}
+	return zp, m
+}
+
+func TestSpyStopped(t *testing.T) {
+	zp, _ := newFakeZeek()
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if result.Empty || result.Inconsistent || len(result.Stack) != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	c := result.Stack[0]
+	if c.Func.Name != "zeek_init" || c.Filename != "base/init.zeek" || c.Line != 12 {
+		t.Errorf("Unexpected call %+v %v", c, c.Func)
+	}
+	if c.Func.Loc.Start != 10 || c.Func.Loc.End != 20 {
+		t.Errorf("Unexpected function location %+v", c.Func.Loc)
+	}
+}
+
+func TestSpyRunningConsistent(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if result.Inconsistent || result.Retries != 0 {
+		t.Errorf("Expected consistent result, got %+v", result)
+	}
+}
+
+func TestSpyRunningTorn(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+
+	// Every read of the call_stack header sees a different size.
+	reads := 0
+	m.beforeRead = func(addr uintptr) {
+		if addr != zp.CallStackAddr {
+			return
+		}
+		reads++
+		finish := uintptr(0x2018)
+		if reads%2 == 0 {
+			finish = 0x2000
+		}
+		m.putPtrs(0x1000, 0x2000, finish, 0x2018)
+	}
+
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if !result.Inconsistent || result.Retries != maxSampleAttempts-1 {
+		t.Errorf("Expected inconsistent result, got %+v", result)
+	}
+	if result.Stack[0].Func.Name != "<inconsistent_sample>" {
+		t.Errorf("Unexpected stack %v", result.Stack[0].Func)
+	}
+}
+
+func TestSpyRunningRetryFailedRead(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+
+	// The Func is gone while the first sample decodes it, but
+	// call_stack stays the same.
+	funcData := m.regions[0x4000]
+	reads := 0
+	m.beforeRead = func(addr uintptr) {
+		if addr != zp.CallStackAddr {
+			return
+		}
+		if reads++; reads == 1 {
+			delete(m.regions, 0x4000)
+		} else {
+			m.put(0x4000, funcData)
+		}
+	}
+
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if result.Inconsistent || result.Retries != 1 || result.Stack[0].Func.Name != "zeek_init" {
+		t.Errorf("Expected retried result, got %+v", result)
+	}
+}
+
+func TestSpyRunningPersistentError(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+	m.putPtrs(0x2000, 0, 0xdead0000, 0)
+	zp.regions = m.regionTable()
+	expectLayoutMismatch(t, zp, "Func")
+}
+
+func TestSpyRunningGarbageHeader(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+	zp.regions = m.regionTable()
+
+	// The first read sees call_stack in the middle of being resized.
+	reads := 0
+	m.beforeRead = func(addr uintptr) {
+		if addr != zp.CallStackAddr {
+			return
+		}
+		if reads++; reads == 1 {
+			m.putPtrs(0x1000, 0x2018, 0x2000, 0x2018)
+		} else {
+			m.putPtrs(0x1000, 0x2000, 0x2018, 0x2018)
+		}
+	}
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if result.Inconsistent || result.Retries != 1 {
+		t.Errorf("Expected retried result, got %+v", result)
+	}
+
+	// Always garbage, that is a layout problem.
+	m.beforeRead = nil
+	m.putPtrs(0x1000, 0x2000, 0x2000+24*(maxVectorLen+1), 0)
+	expectLayoutMismatch(t, zp, "std::vector")
+}
+
+func TestSpyGarbageVector(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.putPtrs(0x1000, 0x2018, 0x2000, 0x2018) // finish < start
+	if _, err := zp.Spy(); err == nil {
+		t.Errorf("Expected error for garbage vector")
+	}
+}
+
+// Use the fake regions as the mappings of the process.
+func (m *fakeMemory) regionTable() *regionTable {
+	table, _ := newRegionTable(func() ([]MemoryRegion, error) {
+		var regions []MemoryRegion
+		for start, data := range m.regions {
+			regions = append(regions, MemoryRegion{Start: start, End: start + uintptr(len(data)), Perms: "rw-p"})
+		}
+		return regions, nil
+	})
+	return table
+}
+
+func expectLayoutMismatch(t *testing.T, zp *ZeekProcess, what string) {
+	t.Helper()
+	_, err := zp.Spy()
+	var mismatch *LayoutMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected LayoutMismatchError, got %v", err)
+	}
+	if mismatch.What != what {
+		t.Errorf("Expected mismatch reading %s, got %v", what, mismatch)
+	}
+}
+
+func TestSpyBadFuncPointer(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.putPtrs(0x2000, 0, 0xdead0000, 0)
+	zp.regions = m.regionTable()
+	expectLayoutMismatch(t, zp, "Func")
+}
+
+func TestSpyHugeVector(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.putPtrs(0x1000, 0x2000, 0x2000+24*(maxVectorLen+1), 0)
+	zp.regions = m.regionTable()
+	expectLayoutMismatch(t, zp, "std::vector")
+}
+
+func TestSpyUnterminatedString(t *testing.T) {
+	zp, m := newFakeZeek()
+	filename := make([]byte, 2*maxStringLen)
+	for i := range filename {
+		filename[i] = 'a'
+	}
+	m.put(0xa000, filename)
+	binary.LittleEndian.PutUint64(m.regions[0x6000][8:], 0xa000)
+	expectLayoutMismatch(t, zp, "string")
+}
+
+// Lengths above maxStringLen are a layout mismatch, not a reason to
+// look for a NUL instead.
+func TestSpyLongString(t *testing.T) {
+	zp, m := newFakeZeek()
+	binary.LittleEndian.PutUint64(m.regions[0x4000][80:], 0xff00000000ff)
+	expectLayoutMismatch(t, zp, "std::string")
+}
+
+// With the old libstdc++ ABI, the name's length is in front of its
+// characters.
+func TestSpyOldABIString(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.stdlib = libstdcxxOldABI{}
+	rep := make([]byte, libstdcxxRepSize)
+	binary.LittleEndian.PutUint64(rep, 9)
+	m.put(0xa000, append(rep, "zeek_init\x00garbage"...))
+	binary.LittleEndian.PutUint64(m.regions[0x4000][72:], 0xa000+libstdcxxRepSize)
+	// No longer part of the string, must not matter.
+	binary.LittleEndian.PutUint64(m.regions[0x4000][80:], 0)
+
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if name := result.Stack[0].Func.Name; name != "zeek_init" {
+		t.Errorf("Expected zeek_init, got %q", name)
+	}
+
+	binary.LittleEndian.PutUint64(m.regions[0xa000], 2*maxStringLen)
+	zp.symbols = newSymbolCache()
+	expectLayoutMismatch(t, zp, "std::string")
+}
+
+func TestSpyNoNextStmt(t *testing.T) {
+	zp, _ := newFakeZeek()
+	offsets := *zp.offsets
+	offsets.FrameNextStmt = 0
+	zp.offsets = &offsets
+
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if len(result.Stack) != 1 {
+		t.Fatalf("Unexpected stack %v", result.Stack)
+	}
+	if c := result.Stack[0]; c.Filename != "base/init.zeek" || c.Line != 10 {
+		t.Errorf("Expected location of zeek_init, got %s:%d", c.Filename, c.Line)
+	}
+}
+
+func TestSymbolCache(t *testing.T) {
+	zp, m := newFakeZeek()
+	reads := 0
+	m.beforeRead = func(addr uintptr) { reads++ }
+
+	first, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	firstReads := reads
+
+	reads = 0
+	second, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	// Both vector headers and data, next_stmt of the top frame, the
+	// Func and the Stmt's location pointer for validation.
+	if reads != 7 || reads >= firstReads {
+		t.Errorf("Expected 7 reads with a warm cache, got %d (%d cold)", reads, firstReads)
+	}
+	if first.Stack[0].Func != second.Stack[0].Func {
+		t.Errorf("Expected the same cached Func")
+	}
+}
+
+func TestSymbolCacheReusedAddress(t *testing.T) {
+	zp, m := newFakeZeek()
+	if _, err := zp.Spy(); err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+
+	// zeek_init() was freed and another Func lives at its address.
+	m.put(0xa000, []byte("zeek_done\x00\x00\x00\x00\x00\x00\x00"))
+	binary.LittleEndian.PutUint64(m.regions[0x4000][72:], 0xa000)
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if name := result.Stack[0].Func.Name; name != "zeek_done" {
+		t.Errorf("Expected zeek_done, got %s", name)
+	}
+}
+
+func TestSymbolCacheOnlyConsistent(t *testing.T) {
+	zp, m := newFakeZeek()
+	m.stopping = false
+
+	// call_stack changes on every read, no sample is consistent.
+	reads := 0
+	m.beforeRead = func(addr uintptr) {
+		if addr == zp.CallStackAddr {
+			reads++
+			m.putPtrs(0x1000, 0x2000, uintptr(0x2000+0x18*(reads%2)), 0x2018)
+		}
+	}
+	result, err := zp.Spy()
+	if err != nil || !result.Inconsistent {
+		t.Fatalf("Expected inconsistent result, got %+v, %v", result, err)
+	}
+	if len(zp.symbols.funcs) != 0 || len(zp.symbols.locations) != 0 {
+		t.Errorf("Expected no cached entries, got %v %v", zp.symbols.funcs, zp.symbols.locations)
+	}
+
+	m.beforeRead = nil
+	m.putPtrs(0x1000, 0x2000, 0x2018, 0x2018)
+	if _, err := zp.Spy(); err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if len(zp.symbols.funcs) != 1 || len(zp.symbols.locations) != 1 {
+		t.Errorf("Expected cached entries, got %v %v", zp.symbols.funcs, zp.symbols.locations)
+	}
+}
+
+func TestSymbolCacheBounded(t *testing.T) {
+	c := newSymbolCache()
+	for i := 0; i <= maxSymbolCacheEntries; i++ {
+		c.pendingFuncs[uintptr(i)] = &cachedFunc{}
+		c.settle(true)
+	}
+	if len(c.funcs) != 1 || len(c.pendingFuncs) != 0 {
+		t.Errorf("Expected the cache to be emptied, got %d entries", len(c.funcs))
+	}
+}
+
+func TestSymbolizeRewriteKeepsCache(t *testing.T) {
+	zp, m := newFakeZeek()
+	// next_stmt in a different file than zeek_init() itself.
+	m.put(0x7200, []byte("other.zeek\x00\x00\x00\x00\x00\x00"))
+	locData := make([]byte, 24)
+	binary.LittleEndian.PutUint64(locData[8:], 0x7200)
+	binary.LittleEndian.PutUint32(locData[16:], 3)
+	m.put(0x6100, locData)
+
+	for i := 0; i < 2; i++ {
+		result, err := zp.Spy()
+		if err != nil {
+			t.Fatalf("Spy failed: %v", err)
+		}
+		if len(result.Stack) != 2 {
+			t.Fatalf("Expected fake call to be prepended, got %v", result.Stack)
+		}
+		if f := result.Stack[0].Func; f.Loc.Filename != "base/init.zeek" || f.Loc.Start != 10 {
+			t.Errorf("Sample %d: unexpected original function %v", i, f)
+		}
+		if f := result.Stack[1].Func; f.Loc.Filename != "other.zeek" || f.Loc.Start != 0 {
+			t.Errorf("Sample %d: unexpected rewritten function %v", i, f)
+		}
+	}
+}
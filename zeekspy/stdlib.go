@@ -0,0 +1,204 @@
+// C++ standard library containers
+//
+// The layout of std::vector and std::string depends on the standard
+// library Zeek was built against: libstdc++ (GCC, and clang on most
+// Linux distributions) or libc++ (clang with -stdlib=libc++). Both
+// are handled for x86_64 with their default ABI, strings of the old
+// libstdc++ ABI as well. Which one applies is decided once per process.
+package zeekspy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	StdLibGNU       = "libstdc++"
+	StdLibGNUOldABI = "libstdc++-old-abi" // _GLIBCXX_USE_CXX11_ABI=0
+	StdLibLLVM      = "libc++"
+)
+
+type stdLibrary interface {
+	Name() string
+
+	// Offsets of the begin and end pointers in a std::vector.
+	vectorBounds() (start, finish int)
+
+	// Number of bytes of a std::string object decodeString needs.
+	stringSize() int
+
+	// Decode the std::string object at addr, obj holding its first
+	// stringSize() bytes. Characters not stored inline are read from
+	// the process.
+	decodeString(zp *ZeekProcess, addr uintptr, obj []byte) (string, error)
+}
+
+// libstdc++ (C++11 ABI):
+//
+//	std::vector: {T* _M_start; T* _M_finish; T* _M_end_of_storage}
+//	std::string: {char* _M_p; size_t _M_string_length; char _M_local_buf[16]}
+//
+// _M_p points into _M_local_buf for short strings, so we never need to
+// look at the inline buffer directly.
+type libstdcxx struct{}
+
+func (libstdcxx) Name() string {
+	return StdLibGNU
+}
+
+func (libstdcxx) vectorBounds() (int, int) {
+	return 0, 8
+}
+
+func (libstdcxx) stringSize() int {
+	return 16
+}
+
+func (libstdcxx) decodeString(zp *ZeekProcess, addr uintptr, obj []byte) (string, error) {
+	ptr := uintptr(binary.LittleEndian.Uint64(obj[0:8]))
+	length := binary.LittleEndian.Uint64(obj[8:16])
+	return zp.readStringData(addr, ptr, length)
+}
+
+// libstdc++ with the old copy-on-write ABI (_GLIBCXX_USE_CXX11_ABI=0):
+//
+//	std::string: {char* _M_p}
+//	in front of the characters: {size_t _M_length; size_t _M_capacity; int _M_refcount}
+type libstdcxxOldABI struct{ libstdcxx }
+
+// Size of the header in front of the characters, including padding.
+const libstdcxxRepSize = 24
+
+func (libstdcxxOldABI) Name() string {
+	return StdLibGNUOldABI
+}
+
+func (libstdcxxOldABI) stringSize() int {
+	return 8
+}
+
+func (libstdcxxOldABI) decodeString(zp *ZeekProcess, addr uintptr, obj []byte) (string, error) {
+	ptr := uintptr(binary.LittleEndian.Uint64(obj[0:8]))
+	data := make([]byte, 8)
+	if err := zp.read("std::string length", ptr-libstdcxxRepSize, data); err != nil {
+		return "", err
+	}
+	return zp.readStringData(addr, ptr, binary.LittleEndian.Uint64(data))
+}
+
+// libc++ (little-endian, default ABI):
+//
+//	std::vector: {T* __begin_; T* __end_; T* __end_cap_}
+//	std::string, long: {size_t __cap_ | 1; size_t __size_; char* __data_}
+//	std::string, short: {unsigned char __size_ << 1; char __data_[23]}
+//
+// The lowest bit of the first byte tells long and short strings apart.
+type libcxx struct{}
+
+// Longest string stored inline.
+const libcxxShortMax = 22
+
+func (libcxx) Name() string {
+	return StdLibLLVM
+}
+
+func (libcxx) vectorBounds() (int, int) {
+	return 0, 8
+}
+
+func (libcxx) stringSize() int {
+	return 24
+}
+
+func (libcxx) decodeString(zp *ZeekProcess, addr uintptr, obj []byte) (string, error) {
+	if obj[0]&1 == 0 {
+		length := int(obj[0] >> 1)
+		if length > libcxxShortMax {
+			return "", &LayoutMismatchError{"std::string", addr, fmt.Sprintf("short string of length %d", length)}
+		}
+		return string(obj[1 : 1+length]), nil
+	}
+	length := binary.LittleEndian.Uint64(obj[8:16])
+	ptr := uintptr(binary.LittleEndian.Uint64(obj[16:24]))
+	return zp.readStringData(addr, ptr, length)
+}
+
+// Read the characters of the std::string at addr.
+func (zp *ZeekProcess) readStringData(addr, ptr uintptr, length uint64) (string, error) {
+	if length > maxStringLen {
+		return "", &LayoutMismatchError{"std::string", addr, fmt.Sprintf("length %d", length)}
+	}
+	data := make([]byte, length)
+	if err := zp.read("std::string data", ptr, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func stdLibraryByName(name string) (stdLibrary, error) {
+	switch name {
+	case StdLibGNU:
+		return libstdcxx{}, nil
+	case StdLibGNUOldABI:
+		return libstdcxxOldABI{}, nil
+	case StdLibLLVM:
+		return libcxx{}, nil
+	}
+	return nil, fmt.Errorf("Unknown standard library %q, use %s, %s or %s", name, StdLibGNU, StdLibGNUOldABI, StdLibLLVM)
+}
+
+// Guess the standard library f was built against: the shared library
+// it links, or the compilers listed in .comment for static builds.
+// For libstdc++, its symbols tell which std::string ABI is used.
+func detectStdLib(f *elf.File) string {
+	if libs, err := f.ImportedLibraries(); err == nil {
+		for _, lib := range libs {
+			if strings.HasPrefix(lib, "libc++.so") {
+				return StdLibLLVM
+			}
+			if strings.HasPrefix(lib, "libstdc++.so") {
+				return detectStringABI(f)
+			}
+		}
+	}
+	if s := f.Section(".comment"); s != nil {
+		if data, err := s.Data(); err == nil {
+			if !bytes.Contains(data, []byte("GCC:")) && bytes.Contains(data, []byte("clang")) {
+				return StdLibLLVM
+			}
+		}
+	}
+	return detectStringABI(f)
+}
+
+func detectStringABI(f *elf.File) string {
+	var names []string
+	for _, symbols := range []func() ([]elf.Symbol, error){f.DynamicSymbols, f.Symbols} {
+		syms, _ := symbols()
+		for _, sym := range syms {
+			names = append(names, sym.Name)
+		}
+	}
+	if oldStringABI(names) {
+		return StdLibGNUOldABI
+	}
+	return StdLibGNU
+}
+
+// Whether symbol names reference the std::string of the old ABI (Ss in
+// mangled names) and none of the C++11 ABI's std::__cxx11 namespace.
+func oldStringABI(names []string) bool {
+	old := false
+	for _, name := range names {
+		if strings.Contains(name, "St7__cxx11") {
+			return false
+		}
+		if strings.HasPrefix(name, "_ZNSs") || strings.HasPrefix(name, "_ZNKSs") {
+			old = true
+		}
+	}
+	return old
+}
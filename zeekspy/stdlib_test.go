@@ -0,0 +1,97 @@
+package zeekspy
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestLibcxxString(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.stdlib = libcxx{}
+	m.put(0xa000, []byte("a string too long to be stored inline"))
+
+	short := make([]byte, 24)
+	short[0] = 9 << 1
+	copy(short[1:], "zeek_init")
+
+	long := make([]byte, 24)
+	binary.LittleEndian.PutUint64(long[0:], 48|1) // capacity, long flag
+	binary.LittleEndian.PutUint64(long[8:], 37)
+	binary.LittleEndian.PutUint64(long[16:], 0xa000)
+
+	for _, tc := range []struct {
+		obj  []byte
+		want string
+	}{
+		{short, "zeek_init"},
+		{make([]byte, 24), ""},
+		{long, "a string too long to be stored inline"},
+	} {
+		got, err := zp.stdlib.decodeString(zp, 0x1234, tc.obj)
+		if err != nil || got != tc.want {
+			t.Errorf("decodeString(%x) = %q, %v, want %q", tc.obj, got, err, tc.want)
+		}
+	}
+
+	bad := make([]byte, 24)
+	bad[0] = 30 << 1
+	var mismatch *LayoutMismatchError
+	if _, err := zp.stdlib.decodeString(zp, 0x1234, bad); !errors.As(err, &mismatch) {
+		t.Errorf("Expected LayoutMismatchError for bad short string, got %v", err)
+	}
+}
+
+func TestSpyLibcxx(t *testing.T) {
+	zp, m := newFakeZeek()
+	zp.stdlib = libcxx{}
+
+	// Func::name as short libc++ string.
+	name := m.regions[0x4000][72:96]
+	for i := range name {
+		name[i] = 0
+	}
+	name[0] = 9 << 1
+	copy(name[1:], "zeek_init")
+
+	result, err := zp.Spy()
+	if err != nil {
+		t.Fatalf("Spy failed: %v", err)
+	}
+	if f := result.Stack[0].Func; f.Name != "zeek_init" {
+		t.Errorf("Unexpected function %v", f)
+	}
+}
+
+func TestDetectStdLib(t *testing.T) {
+	f, err := elf.Open("testdata/dwarf/layout.o")
+	if err != nil {
+		t.Fatalf("Could not open layout.o: %v", err)
+	}
+	defer f.Close()
+	if got := detectStdLib(f); got != StdLibGNU {
+		t.Errorf("Expected %s, got %s", StdLibGNU, got)
+	}
+	if _, err := stdLibraryByName(StdLibGNUOldABI); err != nil {
+		t.Errorf("Expected %s to be known: %v", StdLibGNUOldABI, err)
+	}
+	if _, err := stdLibraryByName("libfoo"); err == nil {
+		t.Errorf("Expected error for unknown standard library")
+	}
+}
+
+func TestOldStringABI(t *testing.T) {
+	for _, tc := range []struct {
+		names []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"main", "_ZNSs4_Rep10_M_disposeERKSaIcE", "_ZNKSs7compareEPKc"}, true},
+		{[]string{"_ZNSs4_Rep10_M_disposeERKSaIcE", "_ZNSt7__cxx1112basic_stringIcSt11char_traitsIcESaIcEE9_M_createERmm"}, false},
+	} {
+		if got := oldStringABI(tc.names); got != tc.want {
+			t.Errorf("oldStringABI(%v) = %v, want %v", tc.names, got, tc.want)
+		}
+	}
+}
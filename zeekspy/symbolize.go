@@ -0,0 +1,227 @@
+// Turning captured pointers into function names and locations
+//
+// Func, Stmt and CallExpr objects as well as their Location live as long
+// as the script function they belong to, so their names and locations
+// only need to be read once. Samples only capture the raw pointers and
+// symbolize() reads whatever is not yet known.
+//
+// With the ptrace based readers, memory can only be read while the
+// process is stopped, so unknown addresses are resolved right after
+// capturing. Readers that do not stop the process leave resolving to a
+// resolver running next to the Sampler. Once the cache is warm, a sample costs reading call_stack,
+// g_frame_stack, the top frame's next_stmt and the fields validating
+// each cached entry.
+package zeekspy
+
+import (
+	"log"
+)
+
+// Raw pointers of one call_stack entry.
+type rawCall struct {
+	Func uintptr // Func*
+	Obj  uintptr // CallExpr* or Stmt* with the current location, or 0
+}
+
+type rawStack struct {
+	Calls []rawCall
+
+	// g_frame_stack was smaller than call_stack, no location
+	// for the top most call.
+	NoFrame bool
+
+	// Frame::next_stmt is unknown for this build, the top most call
+	// is reported at the location of its function.
+	NoNextStmt bool
+}
+
+// Upper bound for the entries of each map of the symbolCache. It is
+// emptied once full, e.g. when a script creates lambdas in a loop.
+const maxSymbolCacheEntries = 65536
+
+// Entries are only added from samples that were read while the process
+// was stopped or that were verified to be consistent, see
+// readCallStackOnce(), or that a resolver resolved without errors.
+// Until then, they are pending. Memory may be freed
+// and reused for different objects, so entries are validated against
+// the fields they were decoded from before use.
+type symbolCache struct {
+	funcs     map[uintptr]*cachedFunc
+	locations map[uintptr]*cachedLocation // By address of the BroObj
+
+	pendingFuncs     map[uintptr]*cachedFunc
+	pendingLocations map[uintptr]*cachedLocation
+}
+
+type cachedFunc struct {
+	f   *Func
+	key string // See funcKey()
+}
+
+type cachedLocation struct {
+	loc    *Location
+	locPtr uintptr // BroObj::location
+}
+
+func newSymbolCache() *symbolCache {
+	return &symbolCache{
+		funcs:            make(map[uintptr]*cachedFunc),
+		locations:        make(map[uintptr]*cachedLocation),
+		pendingFuncs:     make(map[uintptr]*cachedFunc),
+		pendingLocations: make(map[uintptr]*cachedLocation),
+	}
+}
+
+// Add the pending entries to the cache if keep is true, drop them
+// otherwise.
+func (c *symbolCache) settle(keep bool) {
+	if keep {
+		for addr, e := range c.pendingFuncs {
+			if len(c.funcs) >= maxSymbolCacheEntries {
+				c.funcs = make(map[uintptr]*cachedFunc)
+			}
+			c.funcs[addr] = e
+		}
+		for addr, e := range c.pendingLocations {
+			if len(c.locations) >= maxSymbolCacheEntries {
+				c.locations = make(map[uintptr]*cachedLocation)
+			}
+			c.locations[addr] = e
+		}
+	}
+	if len(c.pendingFuncs) > 0 {
+		c.pendingFuncs = make(map[uintptr]*cachedFunc)
+	}
+	if len(c.pendingLocations) > 0 {
+		c.pendingLocations = make(map[uintptr]*cachedLocation)
+	}
+}
+
+func (zp *ZeekProcess) lookupFunc(addr uintptr) (*Func, error) {
+	if e, ok := zp.symbols.pendingFuncs[addr]; ok {
+		return e.f, nil
+	}
+	funcData, err := zp.readFuncData(addr)
+	if err != nil {
+		return nil, err
+	}
+	key := zp.funcKey(funcData)
+	if e, ok := zp.symbols.funcs[addr]; ok && e.key == key {
+		return e.f, nil
+	}
+	delete(zp.symbols.funcs, addr)
+	f, err := zp.decodeFunc(addr, funcData)
+	if err != nil {
+		return nil, err
+	}
+	zp.symbols.pendingFuncs[addr] = &cachedFunc{f, key}
+	return f, nil
+}
+
+func (zp *ZeekProcess) lookupLocation(addr uintptr) (*Location, error) {
+	if e, ok := zp.symbols.pendingLocations[addr]; ok {
+		return e.loc, nil
+	}
+	locPtr, err := zp.readBroObjLocation(addr)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := zp.symbols.locations[addr]; ok && e.locPtr == locPtr {
+		return e.loc, nil
+	}
+	delete(zp.symbols.locations, addr)
+	loc, err := zp.readLocation(locPtr)
+	if err != nil {
+		return nil, err
+	}
+	zp.symbols.pendingLocations[addr] = &cachedLocation{loc, locPtr}
+	return loc, nil
+}
+
+// Resolves the raw stacks of a running process while it is sampled
+// further, for readers that do not stop the process. It reads through
+// its own reader and mappings and is the only user of the symbol cache.
+// Objects may have been freed since they were captured, the validation
+// of cached entries and pointers takes care of that.
+type resolver struct {
+	zp *ZeekProcess
+}
+
+func newResolver(zp *ZeekProcess, mem MemoryReader, regions *regionTable) *resolver {
+	rz := *zp
+	rz.mem, rz.cache, rz.regions = mem, nil, regions
+	return &resolver{&rz}
+}
+
+func (r *resolver) resolve(raw *rawStack) ([]Call, error) {
+	if r.zp.regions != nil {
+		r.zp.regions.expire()
+	}
+	stack, err := r.zp.resolve(raw)
+	r.zp.symbols.settle(err == nil)
+	return stack, err
+}
+
+// Resolve the pointers in raw into Calls.
+func (zp *ZeekProcess) symbolize(raw *rawStack) ([]Call, error) {
+	result := make([]Call, len(raw.Calls))
+	for i, rc := range raw.Calls {
+		f, err := zp.lookupFunc(rc.Func)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = Call{f, "", 0}
+		if rc.Obj == 0 && raw.NoNextStmt && i == len(raw.Calls)-1 {
+			result[i].Filename = f.Loc.Filename
+			result[i].Line = f.Loc.Start
+		} else if rc.Obj != 0 {
+			loc, err := zp.lookupLocation(rc.Obj)
+			if err != nil {
+				return nil, err
+			}
+			result[i].Filename = loc.Filename
+			result[i].Line = loc.Start
+		}
+	}
+
+	if raw.NoFrame {
+		f := result[len(result)-1].Func
+		if f.Kind != BUILTIN_FUNC {
+			log.Printf("[WARN] call_stack larger, non built-in: %+v\n", f)
+		}
+	}
+
+	//
+	// XXX: If the function at call_stack[0] is in a different file
+	//      than what was found via `call` or `Frame->next_stmt`, prepend
+	//      the original name/filename/line as a separate Call and "rewrite"
+	//      the original function to be more in line what the location
+	//      reported...
+	//
+	//      This is a limitations, as there's a single BroObj capturing
+	//      each event handler.
+	//
+	//      Funcs are shared through the cache, so rewrite a copy.
+	//
+	f0 := result[0].Func
+	if f0.Loc.Filename != result[0].Filename {
+
+		fakeFunc := *f0
+
+		// Update entry to at least point to the right filename
+		rewritten := *f0
+		rewritten.Loc.Filename = result[0].Filename
+		rewritten.Loc.Start = 0 // We just don't know :-(
+		rewritten.Loc.End = 0
+		result[0].Func = &rewritten
+
+		fakeCall := Call{&fakeFunc, fakeFunc.Loc.Filename, fakeFunc.Loc.Start}
+		result = append([]Call{fakeCall}, result...)
+	}
+
+	// for i, entry := range result {
+	//	log.Printf("result[%d]=%s:%d %+v\n", i, entry.Filename, entry.Line, entry.Func)
+	// }
+
+	return result, nil
+}
@@ -0,0 +1,93 @@
+// Classes and globals zeek-spy needs, named as in Zeek 4 and later.
+// Compiled into libzeek-layout.so.0 for TestOffsetsFromDwarfZeek4 and
+// TestFindZeekObject:
+//
+//     g++ -g -O0 -shared -fPIC -o libzeek-layout.so.0 layout-zeek4.cc
+//
+// libzeek-layout-stripped.so.0 is the same without debug info, for
+// tests that need the version read from the process:
+//
+//     strip --strip-debug -o libzeek-layout-stripped.so.0 libzeek-layout.so.0
+
+// Decoy with the Zeek 3 name, must not be used.
+struct Location {
+	char pad[100];
+	int filename;
+};
+
+struct String {
+	char* data;
+	unsigned long length;
+	char buf[16];
+};
+
+namespace zeek {
+namespace detail {
+
+class Location final {
+public:
+	const char* filename;
+	int first_line, last_line;
+	int first_column, last_column;
+};
+
+} // namespace detail
+
+class Obj {
+public:
+	virtual ~Obj() {}
+	detail::Location* location;
+	int ref_cnt;
+};
+
+class Func : public Obj {
+public:
+	enum Kind { SCRIPT_FUNC, BUILTIN_FUNC };
+protected:
+	void* bodies[3];
+	void* scope;
+	Kind kind;
+	void* type;
+	String name;
+};
+
+namespace detail {
+
+class Frame {
+	char pad[200];
+	const Obj* next_stmt;
+};
+
+struct CallInfo {
+	const Obj* call;
+	const Func* func;
+	const void* args;
+};
+
+// Stand-ins for the std::vectors.
+struct CallInfoVector {
+	CallInfo* start;
+	CallInfo* finish;
+	CallInfo* end;
+};
+struct FrameVector {
+	Frame** start;
+	Frame** finish;
+	Frame** end;
+};
+
+CallInfoVector call_stack;
+FrameVector g_frame_stack;
+Frame frame;
+
+} // namespace detail
+
+Func func;
+
+} // namespace zeek
+
+::Location decoy;
+
+extern "C" {
+char version[] = "6.0.0";
+}
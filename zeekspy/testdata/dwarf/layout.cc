@@ -0,0 +1,60 @@
+// Classes with the members zeek-spy needs, laid out as in Zeek 3.0.
+// Compiled into layout.o for TestOffsetsFromDwarf:
+//
+//     g++ -g -c -O0 -o layout.o layout.cc
+
+// Same layout as std::string of libstdc++, keeps layout.o small.
+struct String {
+	char* data;
+	unsigned long length;
+	char buf[16];
+};
+
+namespace other {
+struct Location {
+	char pad[100];
+	int filename;
+};
+} // namespace other
+
+struct Location {
+	virtual ~Location() {}
+	const char* filename;
+	int first_line, last_line;
+};
+
+class BroObj {
+public:
+	virtual ~BroObj() {}
+	Location* location;
+};
+
+class Func : public BroObj {
+public:
+	enum Kind { BRO_FUNC, BUILTIN_FUNC };
+protected:
+	void* scope;
+	void* bodies[4];
+	Kind kind;
+	void* type;
+	String name;
+};
+
+class Stmt : public BroObj {};
+
+class Frame {
+	char pad[144];
+	Stmt* next_stmt;
+};
+
+struct CallInfo {
+	const BroObj* call;
+	const Func* func;
+	const void* args;
+};
+
+other::Location other_location;
+Location location;
+Func func;
+Frame frame;
+CallInfo call_info;